@@ -16,6 +16,7 @@ import (
 	"github.com/choerodon/go-register-server/pkg/api/repository"
 	"github.com/choerodon/go-register-server/pkg/api/server"
 	"github.com/choerodon/go-register-server/pkg/k8s"
+	"github.com/choerodon/go-register-server/pkg/utils"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
 )
 
@@ -38,7 +39,36 @@ func NewServerCommand() *cobra.Command {
 	return cmd
 }
 
+// validateConfig 校验启动配置，配置不合法时直接退出
+func validateConfig() {
+	eureka := embed.Env.Eureka
+	if !utils.IsValidIpFamilyPolicy(eureka.IpFamilyPolicy) {
+		glog.Fatalf("Unknown eureka.ipFamilyPolicy %s, expect primary, ipv4 or ipv6", eureka.IpFamilyPolicy)
+	}
+	// 间隔为 0 时 wait.Until 会不停地执行，期望心跳间隔为 0 时自我保护的阈值无法计算
+	intervals := map[string]int{
+		"eureka.eviction.interval":                    eureka.Eviction.IntervalInSecs,
+		"eureka.preservation.expectedRenewalInterval": eureka.Preservation.ExpectedRenewalIntervalInSecs,
+	}
+	if eureka.Health.Enabled {
+		intervals["eureka.health.interval"] = eureka.Health.IntervalInSecs
+	}
+	for name, interval := range intervals {
+		if interval <= 0 {
+			glog.Fatalf("Invalid %s %d, expect a positive number of seconds", name, interval)
+		}
+	}
+	if election := embed.Env.LeaderElection; election.Enabled && (election.RetryPeriodInSecs <= 0 ||
+		election.RenewDeadlineInSecs <= election.RetryPeriodInSecs ||
+		election.LeaseDurationInSecs <= election.RenewDeadlineInSecs) {
+		glog.Fatalf("Invalid leaderElection, expect leaseDuration %d > renewDeadline %d > retryPeriod %d > 0",
+			election.LeaseDurationInSecs, election.RenewDeadlineInSecs, election.RetryPeriodInSecs)
+	}
+}
+
 func Run(s *options.ServerRunOptions, stopCh <-chan struct{}) error {
+	validateConfig()
+
 	k8s.AppRepo = repository.NewApplicationRepository()
 
 	registerServer := server.CreateRegisterServer(s.RegisterServerOptions)
@@ -55,6 +85,15 @@ func Run(s *options.ServerRunOptions, stopCh <-chan struct{}) error {
 	}
 
 	k8s.KubeInformerFactory = kubeInformers.NewSharedInformerFactory(k8s.KubeClient, time.Second*30)
+	k8s.NewNamespacedInformers(k8s.KubeClient, time.Second*30)
+
+	if len(embed.Env.RegisterServiceNamespaceSelector) > 0 {
+		namespaceOperator, err := k8s.NewNamespaceOperator()
+		if err != nil {
+			glog.Fatalf("Error building namespace operator: %s", err.Error())
+		}
+		go namespaceOperator.StartMonitor(stopCh)
+	}
 
 	if embed.Env.ConfigServer.Enabled {
 		go k8s.NewConfigMapOperator().StartMonitor(stopCh)
@@ -62,7 +101,20 @@ func Run(s *options.ServerRunOptions, stopCh <-chan struct{}) error {
 
 	go k8s.NewPodAgent().StartMonitor(stopCh)
 
+	if embed.Env.Eureka.NodeFailure.Enabled {
+		go k8s.NewNodeOperator().StartMonitor(stopCh)
+	}
+
+	if embed.Env.Eureka.Endpoints.Enabled {
+		go k8s.NewEndpointsOperator().StartMonitor(stopCh)
+	}
+
+	go k8s.NewPeerNodes().StartReplication(stopCh)
+
+	go k8s.NewLeaderElector().Run(stopCh)
+
 
+	k8s.Informers.Start(stopCh)
 	k8s.KubeInformerFactory.Start(stopCh)
 
 	return registerServer.PrepareRun().Run(stopCh)
@@ -1,8 +1,10 @@
 package entity
 
 import (
+	"encoding/xml"
 	"gopkg.in/go-playground/validator.v9"
 	"html/template"
+	"sort"
 	"time"
 )
 
@@ -11,22 +13,63 @@ type ApplicationResources struct {
 }
 
 type Applications struct {
+	XMLName         xml.Name       `xml:"applications" json:"-"`
 	ApplicationList []*Application `xml:"application" json:"application"`
 	AppsHashcode    string         `xml:"apps__hashcode" json:"apps__hashcode"`
 	VersionsDelta   int            `xml:"versions__delta" json:"versions__delta"`
 }
 
 type Application struct {
+	XMLName   xml.Name    `xml:"application" json:"-"`
 	Name      string      `xml:"name" json:"name"`
 	Instances []*Instance `xml:"instance" json:"instance"`
 }
 
+type ApplicationResource struct {
+	Application *Application `xml:"application" json:"application"`
+}
+
+type InstanceResource struct {
+	Instance *Instance `xml:"instance" json:"instance"`
+}
+
+// ReplicationList 是 /eureka/peerreplication/batch 的请求体，与 eureka 的 peer 批量复制格式一致
+type ReplicationList struct {
+	ReplicationList []*ReplicationInstance `json:"replicationList"`
+}
+
+type ReplicationInstance struct {
+	AppName            string    `json:"appName"`
+	Id                 string    `json:"id"`
+	LastDirtyTimestamp uint64    `json:"lastDirtyTimestamp,omitempty"`
+	OverriddenStatus   string    `json:"overriddenStatus,omitempty"`
+	Status             string    `json:"status,omitempty"`
+	InstanceInfo       *Instance `json:"instanceInfo,omitempty"`
+	Action             string    `json:"action"`
+}
+
+type ReplicationListResponse struct {
+	ResponseList []*ReplicationInstanceResponse `json:"responseList"`
+}
+
+type ReplicationInstanceResponse struct {
+	StatusCode     int       `json:"statusCode"`
+	ResponseEntity *Instance `json:"responseEntity,omitempty"`
+}
+
+// WatchedNamespace 是注册中心监听的 namespace 及监听的原因
+type WatchedNamespace struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
 type EurekaPage struct {
-	GeneralInfo        map[string]interface{}
-	InstanceInfo       map[string]interface{}
-	EurekaInstances    []*EurekaInstance
-	AvailableRegisters []*Instance
-	CurrentTime        time.Time
+	GeneralInfo          map[string]interface{}
+	InstanceInfo         map[string]interface{}
+	EurekaInstances      []*EurekaInstance
+	AvailableRegisters   []*Instance
+	CurrentTime          time.Time
+	SelfPreservationMode bool
 }
 
 type EurekaInstance struct {
@@ -41,35 +84,39 @@ type EurekaInstance struct {
 
 // Supported statuses
 const (
-	UP                = "UP"
-	DOWN              = "DOWN"
-	ADDED             = "ADDED"
-	STARTING          = "STARTING"
-	OUTOFSERVICE      = "OUT_OF_SERVICE"
-	UNKNOWN           = "UNKNOWN"
-	CUSTOM_APP_PREFIX = "custom"
-	DATA_CENTRE_CLASS = "com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo"
-	DATA_CENTRE_NAME  = "MyOwn"
+	UP                   = "UP"
+	DOWN                 = "DOWN"
+	ADDED                = "ADDED"
+	MODIFIED             = "MODIFIED"
+	DELETED              = "DELETED"
+	STARTING             = "STARTING"
+	OUTOFSERVICE         = "OUT_OF_SERVICE"
+	UNKNOWN              = "UNKNOWN"
+	CUSTOM_APP_PREFIX    = "custom"
+	DATA_CENTRE_CLASS    = "com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo"
+	DATA_CENTRE_NAME     = "MyOwn"
+	EMPTY_METADATA_CLASS = "java.util.Collections$EmptyMap"
 )
 
 type Instance struct {
-	InstanceId       string            `xml:"instanceId" json:"instanceId"`
-	HostName         string            `xml:"hostName" json:"hostName"`
-	App              string            `xml:"app" json:"app"`
-	IPAddr           string            `xml:"ipAddr" json:"ipAddr"`
-	Status           string            `xml:"status" json:"status"`
-	OverriddenStatus string            `xml:"overriddenstatus" json:"overriddenstatus"`
-	Port             Port              `xml:"port" json:"port"`
-	SecurePort       Port              `xml:"securePort" json:"securePort"`
-	CountryId        uint64            `xml:"countryId" json:"countryId"`
-	DataCenterInfo   DataCenterInfo    `xml:"dataCenterInfo" json:"dataCenterInfo"`
-	LeaseInfo        LeaseInfo         `xml:"leaseInfo" json:"leaseInfo"`
-	Metadata         map[string]string `xml:"metadata" json:"metadata"`
-	HomePageUrl      string            `xml:"homePageUrl" json:"homePageUrl"`
-	StatusPageUrl    string            `xml:"statusPageUrl" json:"statusPageUrl"`
-	HealthCheckUrl   string            `xml:"healthCheckUrl" json:"healthCheckUrl"`
-	VipAddress       string            `xml:"vipAddress" json:"vipAddress"`
-	SecureVipAddress string            `xml:"secureVipAddress" json:"secureVipAddress"`
+	XMLName          xml.Name       `xml:"instance" json:"-"`
+	InstanceId       string         `xml:"instanceId" json:"instanceId"`
+	HostName         string         `xml:"hostName" json:"hostName"`
+	App              string         `xml:"app" json:"app"`
+	IPAddr           string         `xml:"ipAddr" json:"ipAddr"`
+	Status           string         `xml:"status" json:"status"`
+	OverriddenStatus string         `xml:"overriddenstatus" json:"overriddenstatus"`
+	Port             Port           `xml:"port" json:"port"`
+	SecurePort       Port           `xml:"securePort" json:"securePort"`
+	CountryId        uint64         `xml:"countryId" json:"countryId"`
+	DataCenterInfo   DataCenterInfo `xml:"dataCenterInfo" json:"dataCenterInfo"`
+	LeaseInfo        LeaseInfo      `xml:"leaseInfo" json:"leaseInfo"`
+	Metadata         Metadata       `xml:"metadata" json:"metadata"`
+	HomePageUrl      string         `xml:"homePageUrl" json:"homePageUrl"`
+	StatusPageUrl    string         `xml:"statusPageUrl" json:"statusPageUrl"`
+	HealthCheckUrl   string         `xml:"healthCheckUrl" json:"healthCheckUrl"`
+	VipAddress       string         `xml:"vipAddress" json:"vipAddress"`
+	SecureVipAddress string         `xml:"secureVipAddress" json:"secureVipAddress"`
 
 	IsCoordinatingDiscoveryServer bool `xml:"isCoordinatingDiscoveryServer" json:"isCoordinatingDiscoveryServer"`
 
@@ -79,13 +126,64 @@ type Instance struct {
 }
 
 type Port struct {
-	Enabled bool  `xml:"@enabled" json:"@enabled"`
-	Port    int32 `xml:"$" json:"$"`
+	Enabled bool  `xml:"enabled,attr" json:"@enabled"`
+	Port    int32 `xml:",chardata" json:"$"`
 }
 
 type DataCenterInfo struct {
-	Name  string `xml:"name" json:"name"`
-	Class string `xml:"@class" json:"@class"`
+	Name     string              `xml:"name" json:"name"`
+	Class    string              `xml:"class,attr" json:"@class"`
+	Metadata *DataCenterMetadata `xml:"metadata,omitempty" json:"metadata,omitempty"`
+}
+
+// DataCenterMetadata 是实例所在的可用区与地域，键名与 eureka 的 AmazonInfo 一致
+type DataCenterMetadata struct {
+	AvailabilityZone string `xml:"availability-zone,omitempty" json:"availability-zone,omitempty"`
+	Region           string `xml:"region,omitempty" json:"region,omitempty"`
+}
+
+// Metadata 实例的元数据，xml 格式下每个键值对为 metadata 的子节点，与 eureka 保持一致
+type Metadata map[string]string
+
+func (m Metadata) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if len(m) == 0 {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "class"}, Value: EMPTY_METADATA_CLASS})
+		return e.EncodeElement("", start)
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := e.EncodeElement(m[k], xml.StartElement{Name: xml.Name{Local: k}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+func (m *Metadata) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	*m = Metadata{}
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			var value string
+			if err := d.DecodeElement(&value, &t); err != nil {
+				return err
+			}
+			(*m)[t.Name.Local] = value
+		case xml.EndElement:
+			return nil
+		}
+	}
 }
 
 type LeaseInfo struct {
@@ -124,6 +222,8 @@ type SaveConfigDTO struct {
 	Namespace    string `json:"namespace" validate:"required"`
 	Yaml         string `json:"yaml"`
 	UpdatePolicy string `json:"updatePolicy" validate:"updatePolicy"`
+	// 更新时基于该版本做冲突检测，为空时直接覆盖
+	ResourceVersion string `json:"-"`
 }
 
 type ZuulRootDTO struct {
@@ -158,6 +258,8 @@ const (
 	ChoerodonFeature          = "choerodon.io/feature"
 	ChoerodonFeatureConfig    = "spring-cloud-config"
 	ChoerodonContextPathLabel = "choerodon.io/context-path"
+	ChoerodonVipAddress       = "choerodon.io/vip-address"
+	ChoerodonSecureVipAddress = "choerodon.io/secure-vip-address"
 	DefaultProfile            = "default"
 	RegisterServerName        = "go-register-server"
 	RouteConfigMap            = "zuul-route"
@@ -166,6 +268,57 @@ const (
 	RoutesNode                = "routes"
 )
 
+// RegisterServerPort 是每个 go-register-server 副本监听的端口，副本之间通过该端口同步实例
+const RegisterServerPort = 8000
+
+// pod 中服务容器与端口的选择
+const (
+	// 多容器的 pod 通过该注解指定服务所在的容器名
+	ChoerodonContainerAnnotation = "choerodon.io/container"
+	// 通过该注解指定服务端口，可以是端口名或端口号
+	ChoerodonPortAnnotation = "choerodon.io/port"
+	// 通过该注解或标签指定并启用 https 端口，可以是端口名或端口号，启用后实例的地址使用 https
+	ChoerodonSecurePortAnnotation = "choerodon.io/secure-port"
+	// 通过该注解或标签为 true 时管理端口也使用 https，否则状态页与健康检查地址使用 http
+	ChoerodonManagementSecureAnnotation = "choerodon.io/management-secure"
+	// 未指定端口时优先使用该名称的端口
+	DefaultPortName = "http"
+)
+
+// pod 生成的实例的 provisioner 元数据
+const PodProvisioner = "pod"
+
+// 通过 Service 的 Endpoints 发现实例
+const (
+	// 带有该注解且值为 true 的 Service，其 Endpoints 中的地址注册为实例
+	ChoerodonRegisterAnnotation = "choerodon.io/register"
+	// Endpoints 生成的实例的 provisioner 元数据
+	EndpointsProvisioner = "endpoints"
+)
+
+// 实例所在的可用区与地域
+const (
+	// 节点的拓扑标签，旧版本的 k8s 使用 failure-domain.beta.kubernetes.io 前缀
+	TopologyZoneLabel         = "topology.kubernetes.io/zone"
+	TopologyRegionLabel       = "topology.kubernetes.io/region"
+	LegacyTopologyZoneLabel   = "failure-domain.beta.kubernetes.io/zone"
+	LegacyTopologyRegionLabel = "failure-domain.beta.kubernetes.io/region"
+	// spring cloud 的 eureka 客户端从实例的该元数据读取可用区
+	ZoneMetadataKey   = "zone"
+	RegionMetadataKey = "region"
+)
+
+// peer 复制的操作类型
+const (
+	ReplicationRegister             = "Register"
+	ReplicationHeartbeat            = "Heartbeat"
+	ReplicationCancel               = "Cancel"
+	ReplicationStatusUpdate         = "StatusUpdate"
+	ReplicationDeleteStatusOverride = "DeleteStatusOverride"
+	// 带有该请求头的请求来自其它 peer，不会再次复制
+	ReplicationHeader = "x-netflix-discovery-replication"
+)
+
 const (
 	UpdatePolicyAdd      = "add"
 	UpdatePolicyNot      = "not"
@@ -187,6 +340,15 @@ var ConfigServerAdditions = map[string]interface{}{
 	"spring.sleuth.scheduled.enabled":              false,
 	"sampler.percentage":                           1}
 
+// IsValidStatus 判断是否为 eureka 支持的实例状态
+func IsValidStatus(status string) bool {
+	switch status {
+	case UP, DOWN, STARTING, OUTOFSERVICE, UNKNOWN:
+		return true
+	}
+	return false
+}
+
 func ValidateUpdatePolicy(fl validator.FieldLevel) bool {
 	v := fl.Field().String()
 	return v == UpdatePolicyAdd || v == UpdatePolicyNot || v == UpdatePolicyOverride || v == UpdatePolicyUpdate
@@ -0,0 +1,49 @@
+package entity
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestInstanceXml(t *testing.T) {
+	instance := &Instance{
+		InstanceId:     "10.0.0.1:test-service:8080",
+		App:            "test-service",
+		Port:           Port{Enabled: true, Port: 8080},
+		DataCenterInfo: DataCenterInfo{Class: DATA_CENTRE_CLASS, Name: DATA_CENTRE_NAME},
+		Metadata:       map[string]string{"version": "1.0.0"},
+	}
+	bytes, err := xml.Marshal(instance)
+	if err != nil {
+		t.Fatalf("marshal instance to xml error: %v", err)
+	}
+	data := string(bytes)
+	for _, expect := range []string{
+		`<port enabled="true">8080</port>`,
+		`<dataCenterInfo class="com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo"><name>MyOwn</name></dataCenterInfo>`,
+		`<metadata><version>1.0.0</version></metadata>`,
+	} {
+		if !strings.Contains(data, expect) {
+			t.Errorf("instance xml %s does not contain %s", data, expect)
+		}
+	}
+
+	parsed := new(Instance)
+	if err := xml.Unmarshal(bytes, parsed); err != nil {
+		t.Fatalf("unmarshal instance from xml error: %v", err)
+	}
+	if parsed.Port.Port != 8080 || !parsed.Port.Enabled || parsed.Metadata["version"] != "1.0.0" {
+		t.Errorf("unmarshal instance from xml error: %+v", parsed)
+	}
+}
+
+func TestEmptyMetadataXml(t *testing.T) {
+	bytes, err := xml.Marshal(&Instance{})
+	if err != nil {
+		t.Fatalf("marshal instance to xml error: %v", err)
+	}
+	if !strings.Contains(string(bytes), `<metadata class="java.util.Collections$EmptyMap"></metadata>`) {
+		t.Errorf("empty metadata xml error: %s", bytes)
+	}
+}
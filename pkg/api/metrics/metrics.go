@@ -16,9 +16,50 @@ var (
 		},
 		[]string{"path"},
 	)
+	SelfPreservationMode = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "eureka_self_preservation_mode",
+		Help: "whether the self preservation mode is on, 1 means on.",
+	})
+	RenewsLastMin = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "eureka_renews_last_min",
+		Help: "number of renews received in the last minute.",
+	})
+	RenewsThreshold = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "eureka_renews_threshold",
+		Help: "expected minimum number of renews per minute.",
+	})
+	PeerReplicationCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "eureka_peer_replication_total",
+			Help: "Total of the replication tasks sent to peers.",
+		},
+		[]string{"result"},
+	)
+	Leader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "eureka_leader",
+		Help: "whether this replica is the leader, 1 means leader.",
+	})
+	HealthCheckCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "eureka_health_check_total",
+			Help: "Total of the instance health checks by result status.",
+		},
+		[]string{"status"},
+	)
+	UnhealthyInstances = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "eureka_unhealthy_instances",
+		Help: "number of instances whose health check status is not UP.",
+	})
 )
 
 func init() {
 	prometheus.MustRegister(RequestCount)
 	prometheus.MustRegister(FetchProcessTime)
+	prometheus.MustRegister(SelfPreservationMode)
+	prometheus.MustRegister(RenewsLastMin)
+	prometheus.MustRegister(RenewsThreshold)
+	prometheus.MustRegister(PeerReplicationCount)
+	prometheus.MustRegister(Leader)
+	prometheus.MustRegister(HealthCheckCount)
+	prometheus.MustRegister(UnhealthyInstances)
 }
@@ -0,0 +1,140 @@
+package repository
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+)
+
+// 增量队列中变更记录的保留时长，与 eureka server 的 retentionTimeInMSInDeltaQueue 默认值一致
+const deltaRetention = 3 * time.Minute
+
+type recentlyChangedItem struct {
+	lastUpdateTime time.Time
+	instance       *entity.Instance
+}
+
+// deltaQueue 保存最近一段时间内发生变更的实例，供 /eureka/apps/delta 增量拉取
+type deltaQueue struct {
+	lock      sync.Mutex
+	items     []*recentlyChangedItem
+	version   int
+	retention time.Duration
+}
+
+func newDeltaQueue(retention time.Duration) *deltaQueue {
+	return &deltaQueue{
+		items:     make([]*recentlyChangedItem, 0),
+		retention: retention,
+	}
+}
+
+// add 记录实例变更的快照并递增注册表版本，返回新的版本号
+func (q *deltaQueue) add(instance *entity.Instance, now time.Time) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.purge(now)
+	q.items = append(q.items, &recentlyChangedItem{
+		lastUpdateTime: now,
+		instance:       instance,
+	})
+	q.version++
+	return q.version
+}
+
+// changes 返回保留时长内的所有变更（按发生顺序）及当前版本号
+func (q *deltaQueue) changes(now time.Time) ([]*entity.Instance, int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.purge(now)
+	instances := make([]*entity.Instance, 0, len(q.items))
+	for _, item := range q.items {
+		instances = append(instances, item.instance)
+	}
+	return instances, q.version
+}
+
+func (q *deltaQueue) currentVersion() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.version
+}
+
+// purge 移除超过保留时长的变更，调用方需持有锁
+func (q *deltaQueue) purge(now time.Time) {
+	expired := 0
+	for _, item := range q.items {
+		if now.Sub(item.lastUpdateTime) <= q.retention {
+			break
+		}
+		expired++
+	}
+	if expired > 0 {
+		q.items = append(q.items[:0], q.items[expired:]...)
+	}
+}
+
+// recordChange 将实例的副本以指定的变更类型放入增量队列，需在写入存储之后调用，
+// 以保证版本号递增时注册表快照能读取到最新的实例。副本叠加了健康检查的结果，与全量注册表一致
+func (appRepo *ApplicationRepository) recordChange(instance *entity.Instance, actionType string) {
+	now := time.Now()
+	changed := *appRepo.applyHealth(instance)
+	changed.ActionType = actionType
+	changed.LastUpdatedTimestamp = uint64(now.UnixNano() / 1e6)
+	appRepo.delta.add(&changed, now)
+}
+
+// GetApplicationDelta 返回增量队列中的变更实例，按应用分组
+func (appRepo *ApplicationRepository) GetApplicationDelta() *entity.ApplicationResources {
+	instances, version := appRepo.delta.changes(time.Now())
+	appResource := &entity.ApplicationResources{
+		Applications: &entity.Applications{
+			VersionsDelta:   version,
+			AppsHashcode:    appRepo.GetSnapshot().Resources.Applications.AppsHashcode,
+			ApplicationList: make([]*entity.Application, 0),
+		},
+	}
+	appMap := make(map[string]*entity.Application)
+	for _, instance := range instances {
+		app, ok := appMap[instance.App]
+		if !ok {
+			app = &entity.Application{
+				Name:      instance.App,
+				Instances: make([]*entity.Instance, 0),
+			}
+			appMap[instance.App] = app
+			appResource.Applications.ApplicationList = append(appResource.Applications.ApplicationList, app)
+		}
+		app.Instances = append(app.Instances, instance)
+	}
+	return appResource
+}
+
+// computeAppsHashcode 按照 eureka 的规则计算注册表的 hashcode：
+// 统计各状态的实例数，按状态名排序后拼接为 "DOWN_2_UP_5_" 的形式，
+// 客户端应用增量后会以此校验本地注册表是否与服务端一致
+func computeAppsHashcode(applications []*entity.Application) string {
+	statusCount := make(map[string]int)
+	for _, app := range applications {
+		for _, instance := range app.Instances {
+			statusCount[instance.Status]++
+		}
+	}
+	statuses := make([]string, 0, len(statusCount))
+	for status := range statusCount {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	var builder strings.Builder
+	for _, status := range statuses {
+		builder.WriteString(status)
+		builder.WriteString("_")
+		builder.WriteString(strconv.Itoa(statusCount[status]))
+		builder.WriteString("_")
+	}
+	return builder.String()
+}
@@ -0,0 +1,201 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+)
+
+func TestGetApplicationDelta(t *testing.T) {
+	appRepo := NewApplicationRepository()
+	instance := &entity.Instance{InstanceId: "10.0.0.1:test-service:8080", App: "test-service", Status: entity.UP}
+	appRepo.Register(instance, "test/test-service-0")
+	appRepo.DeleteInstance("test/test-service-0")
+
+	delta := appRepo.GetApplicationDelta().Applications
+	if delta.VersionsDelta != 2 {
+		t.Errorf("GetApplicationDelta version error, expect 2 but %d", delta.VersionsDelta)
+	}
+	if len(delta.ApplicationList) != 1 || len(delta.ApplicationList[0].Instances) != 2 {
+		t.Fatalf("GetApplicationDelta error, expect 1 app with 2 changes")
+	}
+	changes := delta.ApplicationList[0].Instances
+	if changes[0].ActionType != entity.ADDED || changes[1].ActionType != entity.DELETED {
+		t.Errorf("GetApplicationDelta action type error: %s, %s", changes[0].ActionType, changes[1].ActionType)
+	}
+}
+
+func TestDeltaQueuePurge(t *testing.T) {
+	q := newDeltaQueue(time.Minute)
+	now := time.Now()
+	q.add(&entity.Instance{InstanceId: "old"}, now.Add(-2*time.Minute))
+	q.add(&entity.Instance{InstanceId: "new"}, now)
+
+	instances, version := q.changes(now)
+	if len(instances) != 1 || instances[0].InstanceId != "new" {
+		t.Errorf("deltaQueue purge error, remain %d changes", len(instances))
+	}
+	if version != 2 {
+		t.Errorf("deltaQueue version error, expect 2 but %d", version)
+	}
+}
+
+func TestComputeAppsHashcode(t *testing.T) {
+	applications := []*entity.Application{
+		{Name: "a", Instances: []*entity.Instance{{Status: entity.UP}, {Status: entity.DOWN}, {Status: entity.UP}}},
+		{Name: "b", Instances: []*entity.Instance{{Status: entity.OUTOFSERVICE}, {Status: entity.UP}}},
+	}
+	if hashcode := computeAppsHashcode(applications); hashcode != "DOWN_1_OUT_OF_SERVICE_1_UP_3_" {
+		t.Errorf("computeAppsHashcode error: %s", hashcode)
+	}
+	if hashcode := computeAppsHashcode(nil); hashcode != "" {
+		t.Errorf("computeAppsHashcode of empty registry error: %s", hashcode)
+	}
+}
+
+func TestRegisterModified(t *testing.T) {
+	appRepo := NewApplicationRepository()
+	key := "test/test-service-0"
+	instance := &entity.Instance{InstanceId: "10.0.0.1:test-service:8080", App: "test-service", Status: entity.UP,
+		Metadata: entity.Metadata{"pod-self-link": key, "version": "1.0.0"}}
+	appRepo.Register(instance, key)
+	unchanged := *instance
+	unchanged.LastUpdatedTimestamp = 1
+	if appRepo.Register(&unchanged, key) {
+		t.Errorf("Register should ignore unchanged instance")
+	}
+
+	upgraded := *instance
+	upgraded.Metadata = entity.Metadata{"pod-self-link": key, "version": "1.1.0"}
+	if !appRepo.Register(&upgraded, key) {
+		t.Fatalf("Register should replace changed instance")
+	}
+	if version := appRepo.GetInstance(instance.InstanceId).Metadata["version"]; version != "1.1.0" {
+		t.Errorf("Register expect version 1.1.0 but %s", version)
+	}
+
+	// 实例 id 变化时删除旧的实例
+	moved := upgraded
+	moved.InstanceId = "10.0.0.2:test-service:8080"
+	appRepo.Register(&moved, key)
+	if appRepo.GetInstance(instance.InstanceId) != nil || appRepo.GetInstance(moved.InstanceId) == nil {
+		t.Errorf("Register should replace the instance whose id changed")
+	}
+	changes := appRepo.GetApplicationDelta().Applications.ApplicationList[0].Instances
+	actions := make([]string, 0, len(changes))
+	for _, change := range changes {
+		actions = append(actions, change.ActionType)
+	}
+	if len(actions) != 4 || actions[1] != entity.MODIFIED || actions[2] != entity.DELETED || actions[3] != entity.ADDED {
+		t.Errorf("Register delta error: %v", actions)
+	}
+}
+
+func TestDeleteInstanceOwnedByOtherPod(t *testing.T) {
+	appRepo := NewApplicationRepository()
+	instanceId := "10.0.0.1:test-service:8080"
+	appRepo.Register(&entity.Instance{InstanceId: instanceId, App: "test-service",
+		Metadata: entity.Metadata{"pod-self-link": "test/old"}}, "test/old")
+	// 新 pod 复用了旧 pod 的 ip
+	appRepo.Register(&entity.Instance{InstanceId: instanceId, App: "test-service",
+		Metadata: entity.Metadata{"pod-self-link": "test/new"}}, "test/new")
+	if appRepo.DeleteInstance("test/old") != nil || appRepo.GetInstance(instanceId) == nil {
+		t.Errorf("DeleteInstance should not delete the instance owned by another pod")
+	}
+}
+
+func TestDeleteInstanceKeepsOverlayOfOtherPod(t *testing.T) {
+	appRepo := NewApplicationRepository()
+	instanceId := "10.0.0.1:test-service:8080"
+	appRepo.Register(&entity.Instance{InstanceId: instanceId, App: "test-service", Status: entity.UP,
+		Metadata: entity.Metadata{"pod-self-link": "test/old"}}, "test/old")
+	appRepo.Register(&entity.Instance{InstanceId: instanceId, App: "test-service", Status: entity.UP,
+		Metadata: entity.Metadata{"pod-self-link": "test/new"}}, "test/new")
+	appRepo.SaveCustomInstance(&entity.Instance{InstanceId: instanceId, App: "test-service",
+		Status: entity.OUTOFSERVICE, OverriddenStatus: entity.OUTOFSERVICE,
+		Metadata: entity.Metadata{"pod-self-link": "test/new"}})
+	// 旧 pod 的删除事件晚于新 pod 的注册到达
+	appRepo.DeleteInstance("test/old")
+	if _, ok := appRepo.CustomInstanceStore.Load(instanceId); !ok {
+		t.Errorf("DeleteInstance should keep the overlay of the instance owned by another pod")
+	}
+	if status := appRepo.GetInstance(instanceId).Status; status != entity.OUTOFSERVICE {
+		t.Errorf("DeleteInstance expect status OUT_OF_SERVICE but %s", status)
+	}
+}
+
+func TestRegisterTerminating(t *testing.T) {
+	appRepo := NewApplicationRepository()
+	key := "test/test-service-0"
+	instance := &entity.Instance{InstanceId: "10.0.0.1:test-service:8080", App: "test-service", Status: entity.UP,
+		Metadata: entity.Metadata{"pod-self-link": key}}
+	appRepo.Register(instance, key)
+	appRepo.SaveCustomInstance(&entity.Instance{InstanceId: instance.InstanceId, App: "test-service",
+		Status: entity.UP, Metadata: entity.Metadata{"pod-self-link": key, "zone": "a"}})
+
+	terminating := *instance
+	terminating.Status = entity.OUTOFSERVICE
+	if !appRepo.Register(&terminating, key) {
+		t.Fatalf("Register should replace the terminating instance")
+	}
+	if status := appRepo.GetInstance(instance.InstanceId).Status; status != entity.OUTOFSERVICE {
+		t.Errorf("Register expect status OUT_OF_SERVICE but %s", status)
+	}
+}
+
+func TestRegisterKeepsOverriddenStatusAfterFlap(t *testing.T) {
+	appRepo := NewApplicationRepository()
+	key := "test/test-service-0"
+	instance := &entity.Instance{InstanceId: "10.0.0.1:test-service:8080", App: "test-service", Status: entity.UP,
+		Metadata: entity.Metadata{"pod-self-link": key}}
+	appRepo.Register(instance, key)
+	appRepo.SaveCustomInstance(&entity.Instance{InstanceId: instance.InstanceId, App: "test-service",
+		Status: entity.OUTOFSERVICE, OverriddenStatus: entity.OUTOFSERVICE, Metadata: entity.Metadata{"pod-self-link": key}})
+
+	// readiness 短暂失败后恢复
+	for _, status := range []string{entity.STARTING, entity.UP} {
+		flapped := *instance
+		flapped.Status = status
+		appRepo.Register(&flapped, key)
+	}
+	stored := appRepo.GetInstance(instance.InstanceId)
+	if stored.Status != entity.OUTOFSERVICE || stored.OverriddenStatus != entity.OUTOFSERVICE {
+		t.Errorf("Register expect status OUT_OF_SERVICE after flap but %s, overridden %s",
+			stored.Status, stored.OverriddenStatus)
+	}
+}
+
+func TestClearStatusOverrideKeepsMetadata(t *testing.T) {
+	appRepo := NewApplicationRepository()
+	key := "test/test-service-0"
+	instanceId := "10.0.0.1:test-service:8080"
+	appRepo.Register(&entity.Instance{InstanceId: instanceId, App: "test-service", Status: entity.UP,
+		Metadata: entity.Metadata{"provisioner": entity.PodProvisioner, "pod-self-link": key}}, key)
+	// 修改元数据，再覆盖状态
+	appRepo.SaveCustomInstance(&entity.Instance{InstanceId: instanceId, App: "test-service", Status: entity.UP,
+		Metadata: entity.Metadata{"provisioner": entity.PodProvisioner, "pod-self-link": key, "weight": "10"}})
+	overridden := *appRepo.GetStoredInstance(instanceId)
+	overridden.OverriddenStatus, overridden.Status = entity.OUTOFSERVICE, entity.OUTOFSERVICE
+	appRepo.SaveCustomInstance(&overridden)
+
+	cleared, removed := appRepo.ClearStatusOverride(instanceId)
+	if cleared == nil || removed {
+		t.Fatalf("ClearStatusOverride should keep the overlay with custom metadata")
+	}
+	stored := appRepo.GetInstance(instanceId)
+	if stored.Status != entity.UP || stored.OverriddenStatus != entity.UNKNOWN || stored.Metadata["weight"] != "10" {
+		t.Errorf("ClearStatusOverride error: %s %s %v", stored.Status, stored.OverriddenStatus, stored.Metadata)
+	}
+
+	// 副本中只剩覆盖状态时删除副本
+	appRepo.SaveCustomInstance(&entity.Instance{InstanceId: instanceId, App: "test-service",
+		Status: entity.OUTOFSERVICE, OverriddenStatus: entity.OUTOFSERVICE,
+		Metadata: entity.Metadata{"provisioner": entity.PodProvisioner, "pod-self-link": key}})
+	if _, removed := appRepo.ClearStatusOverride(instanceId); !removed {
+		t.Errorf("ClearStatusOverride should remove the overlay holding the status only")
+	}
+	if _, ok := appRepo.CustomInstanceStore.Load(instanceId); ok {
+		t.Errorf("ClearStatusOverride should remove the overlay holding the status only")
+	}
+}
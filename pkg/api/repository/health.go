@@ -0,0 +1,136 @@
+package repository
+
+import (
+	"sync"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+)
+
+// healthState 记录实例健康检查的结果，新的状态需连续出现指定次数才生效，避免状态抖动
+type healthState struct {
+	status    string
+	candidate string
+	count     int
+}
+
+type healthRegistry struct {
+	lock   sync.Mutex
+	states map[string]*healthState
+}
+
+func newHealthRegistry() *healthRegistry {
+	return &healthRegistry{states: make(map[string]*healthState)}
+}
+
+// ReportHealth 记录一次健康检查的结果，返回生效的健康状态是否发生变化。
+// 变为不健康需连续 failureThreshold 次，恢复为 UP 需连续 successThreshold 次
+func (appRepo *ApplicationRepository) ReportHealth(instanceId string, status string,
+	failureThreshold int, successThreshold int) bool {
+	health := appRepo.health
+	health.lock.Lock()
+	state, ok := health.states[instanceId]
+	if !ok {
+		state = &healthState{status: entity.UP}
+		health.states[instanceId] = state
+	}
+	changed := state.transit(status, failureThreshold, successThreshold)
+	health.lock.Unlock()
+
+	if changed {
+		if instance := appRepo.GetInstance(instanceId); instance != nil {
+			appRepo.recordChange(instance, entity.MODIFIED)
+		}
+	}
+	return changed
+}
+
+func (state *healthState) transit(status string, failureThreshold int, successThreshold int) bool {
+	if status == state.status {
+		state.candidate = ""
+		state.count = 0
+		return false
+	}
+	if status == state.candidate {
+		state.count++
+	} else {
+		state.candidate = status
+		state.count = 1
+	}
+	threshold := failureThreshold
+	if status == entity.UP {
+		threshold = successThreshold
+	}
+	if state.count < threshold {
+		return false
+	}
+	state.status = status
+	state.candidate = ""
+	state.count = 0
+	return true
+}
+
+// HealthStatus 返回实例生效的健康状态，未检查过的实例返回空字符串
+func (appRepo *ApplicationRepository) HealthStatus(instanceId string) string {
+	health := appRepo.health
+	health.lock.Lock()
+	defer health.lock.Unlock()
+	if state, ok := health.states[instanceId]; ok {
+		return state.status
+	}
+	return ""
+}
+
+// CountUnhealthyInstances 返回健康检查结果不为 UP 的实例数
+func (appRepo *ApplicationRepository) CountUnhealthyInstances() int {
+	health := appRepo.health
+	health.lock.Lock()
+	defer health.lock.Unlock()
+	count := 0
+	for _, state := range health.states {
+		if state.status != entity.UP {
+			count++
+		}
+	}
+	return count
+}
+
+// RetainHealth 清除已下线实例的健康检查记录
+func (appRepo *ApplicationRepository) RetainHealth(instanceIds map[string]bool) {
+	health := appRepo.health
+	health.lock.Lock()
+	defer health.lock.Unlock()
+	for instanceId := range health.states {
+		if !instanceIds[instanceId] {
+			delete(health.states, instanceId)
+		}
+	}
+}
+
+// GetHealthCheckInstances 返回配置了健康检查地址的实例，自定义实例覆盖同 id 的 pod 实例
+func (appRepo *ApplicationRepository) GetHealthCheckInstances() []*entity.Instance {
+	instances := make([]*entity.Instance, 0)
+	for _, instance := range appRepo.mergedInstances() {
+		if len(instance.HealthCheckUrl) > 0 {
+			instances = append(instances, instance)
+		}
+	}
+	return instances
+}
+
+// applyHealth 返回叠加健康检查结果后的实例。覆盖状态优先于健康检查结果，
+// 且只有状态为 UP 的实例会因健康检查失败而改变状态
+func (appRepo *ApplicationRepository) applyHealth(instance *entity.Instance) *entity.Instance {
+	if instance.Status != entity.UP {
+		return instance
+	}
+	if len(instance.OverriddenStatus) > 0 && instance.OverriddenStatus != entity.UNKNOWN {
+		return instance
+	}
+	status := appRepo.HealthStatus(instance.InstanceId)
+	if len(status) == 0 || status == entity.UP {
+		return instance
+	}
+	unhealthy := *instance
+	unhealthy.Status = status
+	return &unhealthy
+}
@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+)
+
+func TestReportHealth(t *testing.T) {
+	appRepo := NewApplicationRepository()
+	instanceId := "10.0.0.1:test-service:8080"
+	appRepo.Register(&entity.Instance{InstanceId: instanceId, App: "test-service", Status: entity.UP}, "test/test-service-0")
+
+	// 连续失败次数未达到阈值时状态不变
+	for i := 0; i < 2; i++ {
+		if appRepo.ReportHealth(instanceId, entity.DOWN, 3, 2) {
+			t.Fatalf("ReportHealth should not change status before failure threshold")
+		}
+	}
+	if appRepo.ReportHealth(instanceId, entity.UP, 3, 2) || appRepo.ReportHealth(instanceId, entity.DOWN, 3, 2) {
+		t.Fatalf("ReportHealth should reset the count when status changes back")
+	}
+	appRepo.ReportHealth(instanceId, entity.DOWN, 3, 2)
+	if !appRepo.ReportHealth(instanceId, entity.DOWN, 3, 2) {
+		t.Fatalf("ReportHealth should change status after failure threshold")
+	}
+	if status := appRepo.GetInstance(instanceId).Status; status != entity.DOWN {
+		t.Errorf("GetInstance expect status DOWN but %s", status)
+	}
+	if status := appRepo.GetStoredInstance(instanceId).Status; status != entity.UP {
+		t.Errorf("health status should not modify the stored instance, but %s", status)
+	}
+	if status := appRepo.GetApplicationResources().Applications.ApplicationList[0].Instances[0].Status; status != entity.DOWN {
+		t.Errorf("snapshot expect status DOWN but %s", status)
+	}
+
+	appRepo.ReportHealth(instanceId, entity.UP, 3, 2)
+	if !appRepo.ReportHealth(instanceId, entity.UP, 3, 2) {
+		t.Fatalf("ReportHealth should recover after success threshold")
+	}
+	if status := appRepo.GetInstance(instanceId).Status; status != entity.UP {
+		t.Errorf("GetInstance expect status UP but %s", status)
+	}
+}
+
+func TestApplyHealthOverridden(t *testing.T) {
+	appRepo := NewApplicationRepository()
+	instance := &entity.Instance{InstanceId: "custom-0", App: "custom-service", Status: entity.OUTOFSERVICE,
+		OverriddenStatus: entity.OUTOFSERVICE}
+	appRepo.SaveCustomInstance(instance)
+	appRepo.ReportHealth(instance.InstanceId, entity.DOWN, 1, 1)
+	if status := appRepo.GetInstance(instance.InstanceId).Status; status != entity.OUTOFSERVICE {
+		t.Errorf("overridden status should take precedence over health status, but %s", status)
+	}
+}
+
+func TestDeltaAppliesHealth(t *testing.T) {
+	appRepo := NewApplicationRepository()
+	key := "test/test-service-0"
+	instance := &entity.Instance{InstanceId: "10.0.0.1:test-service:8080", App: "test-service", Status: entity.UP,
+		Metadata: entity.Metadata{"pod-self-link": key, "version": "1.0.0"}}
+	appRepo.Register(instance, key)
+	appRepo.ReportHealth(instance.InstanceId, entity.DOWN, 1, 1)
+
+	// 健康检查失败期间 pod 发生更新
+	upgraded := *instance
+	upgraded.Metadata = entity.Metadata{"pod-self-link": key, "version": "1.1.0"}
+	appRepo.Register(&upgraded, key)
+
+	delta := appRepo.GetApplicationDelta().Applications
+	changes := delta.ApplicationList[0].Instances
+	if last := changes[len(changes)-1]; last.ActionType != entity.MODIFIED || last.Status != entity.DOWN {
+		t.Errorf("delta expect MODIFIED with status DOWN but %s %s", last.ActionType, last.Status)
+	}
+	if delta.AppsHashcode != "DOWN_1_" {
+		t.Errorf("delta apps hashcode error: %s", delta.AppsHashcode)
+	}
+}
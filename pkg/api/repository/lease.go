@@ -0,0 +1,113 @@
+package repository
+
+import (
+	"sync"
+	"time"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+)
+
+// Renew 处理实例心跳：自定义注册的实例刷新租约，pod 生成的实例由 pod 监听维护，直接视为续约成功。
+// 返回 false 表示实例不存在，客户端需要重新注册
+func (appRepo *ApplicationRepository) Renew(instanceId string) bool {
+	if value, ok := appRepo.CustomInstanceStore.Load(instanceId); ok {
+		now := time.Now()
+		renewed := *value.(*entity.Instance)
+		renewed.LeaseInfo.LastRenewalTimestamp = uint64(now.UnixNano() / 1e6)
+		appRepo.CustomInstanceStore.Store(instanceId, &renewed)
+		if isLeaseManaged(&renewed) {
+			appRepo.renewsLastMin.increment(now)
+		}
+		return true
+	}
+	_, ok := appRepo.InstanceStore.Load(instanceId)
+	return ok
+}
+
+// GetExpiredInstances 返回租约已过期的自定义实例，由 pod 生成的实例不参与剔除
+func (appRepo *ApplicationRepository) GetExpiredInstances(now time.Time) []*entity.Instance {
+	expired := make([]*entity.Instance, 0)
+	appRepo.CustomInstanceStore.Range(func(key, value interface{}) bool {
+		instance := value.(*entity.Instance)
+		if isLeaseExpired(instance, now) {
+			expired = append(expired, instance)
+		}
+		return true
+	})
+	return expired
+}
+
+// CountLeaseInstances 返回依赖心跳维持租约的实例数
+func (appRepo *ApplicationRepository) CountLeaseInstances() int {
+	count := 0
+	appRepo.CustomInstanceStore.Range(func(key, value interface{}) bool {
+		if isLeaseManaged(value.(*entity.Instance)) {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// RenewsLastMin 返回上一分钟内收到的心跳次数
+func (appRepo *ApplicationRepository) RenewsLastMin() int {
+	return appRepo.renewsLastMin.lastBucket(time.Now())
+}
+
+// pod 与 Endpoints 生成的实例由监听维护，不依赖心跳
+func isLeaseManaged(instance *entity.Instance) bool {
+	return !IsDiscoveredInstance(instance)
+}
+
+func isLeaseExpired(instance *entity.Instance, now time.Time) bool {
+	if !isLeaseManaged(instance) {
+		return false
+	}
+	lease := instance.LeaseInfo
+	if lease.DurationInSecs == 0 {
+		return false
+	}
+	expireAt := lease.LastRenewalTimestamp + uint64(lease.DurationInSecs)*1000
+	return uint64(now.UnixNano()/1e6) > expireAt
+}
+
+// measuredRate 按分钟统计次数，与 eureka 的 MeasuredRate 一致，读取的是上一个完整分钟的值
+type measuredRate struct {
+	lock        sync.Mutex
+	bucketStart time.Time
+	current     int
+	last        int
+}
+
+func (r *measuredRate) increment(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.rotate(now)
+	r.current++
+}
+
+func (r *measuredRate) lastBucket(now time.Time) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.rotate(now)
+	return r.last
+}
+
+// rotate 在跨过分钟边界时切换统计桶，调用方需持有锁
+func (r *measuredRate) rotate(now time.Time) {
+	if r.bucketStart.IsZero() {
+		r.bucketStart = now
+		return
+	}
+	elapsed := now.Sub(r.bucketStart)
+	if elapsed < time.Minute {
+		return
+	}
+	if elapsed < 2*time.Minute {
+		r.last = r.current
+	} else {
+		r.last = 0
+	}
+	r.current = 0
+	r.bucketStart = r.bucketStart.Add(elapsed.Truncate(time.Minute))
+}
@@ -0,0 +1,46 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+)
+
+func TestMeasuredRate(t *testing.T) {
+	r := &measuredRate{}
+	start := time.Now()
+	r.increment(start)
+	r.increment(start.Add(10 * time.Second))
+	if last := r.lastBucket(start.Add(30 * time.Second)); last != 0 {
+		t.Errorf("measuredRate error, expect 0 before the first minute ends but %d", last)
+	}
+	if last := r.lastBucket(start.Add(70 * time.Second)); last != 2 {
+		t.Errorf("measuredRate error, expect 2 but %d", last)
+	}
+	if last := r.lastBucket(start.Add(5 * time.Minute)); last != 0 {
+		t.Errorf("measuredRate error, expect 0 after idle minutes but %d", last)
+	}
+}
+
+func TestIsLeaseExpired(t *testing.T) {
+	now := time.Now()
+	lease := entity.LeaseInfo{
+		DurationInSecs:       90,
+		LastRenewalTimestamp: uint64(now.Add(-2*time.Minute).UnixNano() / 1e6),
+	}
+	custom := &entity.Instance{Metadata: map[string]string{"provisioner": "custom"}, LeaseInfo: lease}
+	if !isLeaseExpired(custom, now) {
+		t.Errorf("isLeaseExpired error, custom instance should be expired")
+	}
+	pod := &entity.Instance{Metadata: map[string]string{"provisioner": entity.PodProvisioner,
+		"pod-self-link": "test/test-pod"}, LeaseInfo: lease}
+	if isLeaseExpired(pod, now) {
+		t.Errorf("isLeaseExpired error, pod instance should never be expired")
+	}
+	endpoints := &entity.Instance{Metadata: map[string]string{"provisioner": entity.EndpointsProvisioner,
+		"endpoints-self-link": "test/test-service"}, LeaseInfo: lease}
+	if isLeaseExpired(endpoints, now) {
+		t.Errorf("isLeaseExpired error, endpoints instance should never be expired")
+	}
+}
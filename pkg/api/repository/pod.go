@@ -1,9 +1,15 @@
 package repository
 
 import (
+	"fmt"
 	"github.com/choerodon/go-register-server/pkg/api/entity"
 	"github.com/golang/glog"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ApplicationRepository struct {
@@ -11,6 +17,11 @@ type ApplicationRepository struct {
 	NamespaceStore      *sync.Map
 	InstanceStore       *sync.Map
 	CustomInstanceStore *sync.Map
+	delta               *deltaQueue
+	renewsLastMin       *measuredRate
+	health              *healthRegistry
+	snapshot            atomic.Value
+	snapshotLock        sync.Mutex
 }
 
 func NewApplicationRepository() *ApplicationRepository {
@@ -19,73 +30,234 @@ func NewApplicationRepository() *ApplicationRepository {
 		NamespaceStore:      &sync.Map{},
 		InstanceStore:       &sync.Map{},
 		CustomInstanceStore: &sync.Map{},
+		delta:               newDeltaQueue(deltaRetention),
+		renewsLastMin:       &measuredRate{},
+		health:              newHealthRegistry(),
 	}
 }
 
+// Register 保存 pod 生成的实例，返回实例是否新增或发生了变化。
+// pod 的标签等变化时替换已保存的实例并记录为 MODIFIED，实例 id 变化（如 pod ip 变化）时先删除旧的实例
 func (appRepo *ApplicationRepository) Register(instance *entity.Instance, key string) bool {
-	//appStore := appRepo.ApplicationStore
-
-	if _, ok := appRepo.NamespaceStore.Load(key); ok {
-		return false
-	} else {
-		appRepo.NamespaceStore.Store(key, instance.InstanceId)
+	if value, ok := appRepo.NamespaceStore.Load(key); ok {
+		oldInstanceId := value.(string)
+		if oldInstanceId != instance.InstanceId {
+			appRepo.deleteOwnedInstance(oldInstanceId, key)
+		} else if old, ok := appRepo.InstanceStore.Load(oldInstanceId); ok {
+			oldInstance := old.(*entity.Instance)
+			if !isInstanceChanged(oldInstance, instance) {
+				return false
+			}
+			instance.LeaseInfo.RegistrationTimestamp = oldInstance.LeaseInfo.RegistrationTimestamp
+			instance.ActionType = entity.MODIFIED
+			appRepo.InstanceStore.Store(instance.InstanceId, instance)
+			if overlay, ok := appRepo.CustomInstanceStore.Load(instance.InstanceId); ok {
+				refreshed := refreshOverlay(overlay.(*entity.Instance), oldInstance, instance)
+				appRepo.CustomInstanceStore.Store(instance.InstanceId, refreshed)
+				appRepo.recordChange(refreshed, entity.MODIFIED)
+			} else {
+				appRepo.recordChange(instance, entity.MODIFIED)
+			}
+			return true
+		}
 	}
+	appRepo.NamespaceStore.Store(key, instance.InstanceId)
+	instance.ActionType = entity.ADDED
 	appRepo.InstanceStore.Store(instance.InstanceId, instance)
+	appRepo.recordChange(instance, entity.ADDED)
 	return true
 }
 
 func (appRepo *ApplicationRepository) DeleteInstance(key string) *entity.Instance {
-	if value, ok := appRepo.NamespaceStore.Load(key); ok {
-		appRepo.CustomInstanceStore.Delete(value)
-		appRepo.NamespaceStore.Delete(key)
-		if instance, ok := appRepo.InstanceStore.Load(value); ok {
-			appRepo.InstanceStore.Delete(value)
-			if instance != nil {
-				glog.Infof("Delete instance by key %s", key)
-				return instance.(*entity.Instance)
-			}
-		}
-		glog.Infof(" instance by key %s not exist but namespace exist", key)
-	} else {
+	value, ok := appRepo.NamespaceStore.Load(key)
+	if !ok {
 		glog.Infof("Delete instance by key %s not exist", key)
+		return nil
+	}
+	appRepo.NamespaceStore.Delete(key)
+	instance, owned := appRepo.deleteOwnedInstance(value.(string), key)
+	if instance != nil {
+		glog.Infof("Delete instance by key %s", key)
+		return instance
+	}
+	// 实例已属于其它 pod，其自定义覆盖也属于新的 pod
+	if !owned {
+		return nil
 	}
+	if customInstance, ok := appRepo.CustomInstanceStore.Load(value); ok {
+		appRepo.CustomInstanceStore.Delete(value)
+		appRepo.recordChange(customInstance.(*entity.Instance), entity.DELETED)
+	}
+	glog.Infof(" instance by key %s not exist but namespace exist", key)
 	return nil
+}
+
+// deleteOwnedInstance 删除 key 对应的 pod 生成的实例。pod ip 被复用时不同 pod 的实例 id 可能相同，
+// 实例已属于其它 pod 时不删除并返回 false
+func (appRepo *ApplicationRepository) deleteOwnedInstance(instanceId string, key string) (*entity.Instance, bool) {
+	value, ok := appRepo.InstanceStore.Load(instanceId)
+	if !ok {
+		return nil, true
+	}
+	instance := value.(*entity.Instance)
+	if podSelfLink, ok := instance.Metadata["pod-self-link"]; ok && podSelfLink != key {
+		glog.Infof("Instance %s belongs to pod %s, skip deleting by key %s", instanceId, podSelfLink, key)
+		return nil, false
+	}
+	appRepo.CustomInstanceStore.Delete(instanceId)
+	appRepo.InstanceStore.Delete(instanceId)
+	appRepo.recordChange(instance, entity.DELETED)
+	return instance, true
+}
+
+// isInstanceChanged 比较 pod 生成的实例是否发生变化，忽略时间戳与租约信息
+func isInstanceChanged(old *entity.Instance, new *entity.Instance) bool {
+	oldCopy, newCopy := *old, *new
+	for _, instance := range []*entity.Instance{&oldCopy, &newCopy} {
+		instance.ActionType = ""
+		instance.LastDirtyTimestamp = 0
+		instance.LastUpdatedTimestamp = 0
+		instance.LeaseInfo = entity.LeaseInfo{}
+	}
+	return !reflect.DeepEqual(oldCopy, newCopy)
+}
+
+// refreshOverlay 以 pod 的最新实例替换自定义覆盖中的 pod 信息，保留覆盖的状态与自定义的元数据，
+// 来自旧 pod 实例的元数据以新实例为准
+func refreshOverlay(overlay *entity.Instance, oldPodInstance *entity.Instance, podInstance *entity.Instance) *entity.Instance {
+	refreshed := *podInstance
+	// pod 正在启动或删除时以 pod 的状态为准，覆盖沿用的 pod 状态也随 pod 更新；
+	// pod 恢复 UP 时以覆盖状态为准，避免 readiness 抖动后丢失管理员设置的状态
+	if podInstance.Status == entity.UP {
+		if overlay.OverriddenStatus != "" && overlay.OverriddenStatus != entity.UNKNOWN {
+			refreshed.Status = overlay.OverriddenStatus
+		} else if overlay.Status != oldPodInstance.Status {
+			refreshed.Status = overlay.Status
+		}
+	}
+	refreshed.OverriddenStatus = overlay.OverriddenStatus
+	refreshed.LeaseInfo = overlay.LeaseInfo
+	refreshed.LastUpdatedTimestamp = overlay.LastUpdatedTimestamp
+	refreshed.Metadata = make(entity.Metadata, len(overlay.Metadata))
+	for key, value := range overlay.Metadata {
+		if _, ok := oldPodInstance.Metadata[key]; !ok {
+			refreshed.Metadata[key] = value
+		}
+	}
+	for key, value := range podInstance.Metadata {
+		refreshed.Metadata[key] = value
+	}
+	return &refreshed
+}
+
+// SaveCustomInstance 保存自定义注册的实例（或覆盖 pod 生成的实例），并记录到增量队列
+func (appRepo *ApplicationRepository) SaveCustomInstance(instance *entity.Instance) {
+	instance.LastUpdatedTimestamp = uint64(time.Now().UnixNano() / 1e6)
+	appRepo.SyncCustomInstance(instance)
+}
 
+// SyncCustomInstance 保存从 cm 同步的实例，保留实例原有的更新时间，以便与 cm 中的记录比较是否发生变化
+func (appRepo *ApplicationRepository) SyncCustomInstance(instance *entity.Instance) {
+	actionType := entity.ADDED
+	if _, ok := appRepo.CustomInstanceStore.Load(instance.InstanceId); ok {
+		actionType = entity.MODIFIED
+	} else if _, ok := appRepo.InstanceStore.Load(instance.InstanceId); ok {
+		actionType = entity.MODIFIED
+	}
+	instance.ActionType = actionType
+	appRepo.CustomInstanceStore.Store(instance.InstanceId, instance)
+	appRepo.recordChange(instance, actionType)
+}
+
+// IsDiscoveredInstance 返回实例是否由 pod 或 Endpoints 生成，自定义覆盖保留了生成时的 provisioner
+func IsDiscoveredInstance(instance *entity.Instance) bool {
+	switch instance.Metadata["provisioner"] {
+	case entity.PodProvisioner, entity.EndpointsProvisioner:
+		return true
+	}
+	return false
+}
+
+// ClearStatusOverride 移除 pod 或 Endpoints 生成的实例的覆盖状态，使生成时的状态重新生效。
+// 副本中还有自定义的元数据时只重置覆盖状态，否则删除副本并返回 removed 为 true；实例不是生成的实例时返回 nil
+func (appRepo *ApplicationRepository) ClearStatusOverride(instanceId string) (*entity.Instance, bool) {
+	value, ok := appRepo.InstanceStore.Load(instanceId)
+	if !ok || !IsDiscoveredInstance(value.(*entity.Instance)) {
+		return nil, false
+	}
+	podInstance := value.(*entity.Instance)
+	overlay, ok := appRepo.CustomInstanceStore.Load(instanceId)
+	if !ok {
+		return podInstance, true
+	}
+	if !isMetadataEqual(overlay.(*entity.Instance).Metadata, podInstance.Metadata) {
+		cleared := *overlay.(*entity.Instance)
+		cleared.OverriddenStatus = entity.UNKNOWN
+		cleared.Status = podInstance.Status
+		appRepo.SaveCustomInstance(&cleared)
+		return &cleared, false
+	}
+	appRepo.RemoveCustomInstance(instanceId)
+	return podInstance, true
 }
 
+func isMetadataEqual(a entity.Metadata, b entity.Metadata) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// RemoveCustomInstance 删除自定义注册的实例；若实例由 pod 或 Endpoints 生成，则只移除自定义的覆盖信息
+func (appRepo *ApplicationRepository) RemoveCustomInstance(instanceId string) {
+	value, ok := appRepo.CustomInstanceStore.Load(instanceId)
+	if !ok {
+		return
+	}
+	appRepo.CustomInstanceStore.Delete(instanceId)
+	instance := value.(*entity.Instance)
+	if IsDiscoveredInstance(instance) {
+		if podInstance, ok := appRepo.InstanceStore.Load(instanceId); ok {
+			appRepo.recordChange(podInstance.(*entity.Instance), entity.MODIFIED)
+		}
+		return
+	}
+	appRepo.NamespaceStore.Delete(fmt.Sprintf("%s/%s", entity.CUSTOM_APP_PREFIX, instanceId))
+	appRepo.recordChange(instance, entity.DELETED)
+}
+
+// GetApplicationResources 返回当前注册表快照中的应用列表，返回值为共享的只读对象，调用方不能修改
 func (appRepo *ApplicationRepository) GetApplicationResources() *entity.ApplicationResources {
+	return appRepo.GetSnapshot().Resources
+}
+
+// buildApplicationResources 构建注册表，实例状态叠加了健康检查的结果
+func (appRepo *ApplicationRepository) buildApplicationResources(version int) *entity.ApplicationResources {
 	appResource := &entity.ApplicationResources{
 		Applications: &entity.Applications{
-			VersionsDelta:   2,
-			AppsHashcode:    "app_hashcode",
+			VersionsDelta:   version,
 			ApplicationList: make([]*entity.Application, 0),
 		},
 	}
 	appMap := make(map[string]*entity.Application)
-
-	appRepo.CustomInstanceStore.Range(func(key, value interface{}) bool {
-		instanceId := key.(string)
-		instance := value.(*entity.Instance)
-		appRepo.InstanceStore.Store(instanceId, instance)
-		return true
-	})
-
-	appRepo.InstanceStore.Range(func(key, value interface{}) bool {
-		instance := value.(*entity.Instance)
-		if appMap[instance.App] == nil {
-			app := &entity.Application{
+	for _, instance := range appRepo.mergedInstances() {
+		instance = appRepo.applyHealth(instance)
+		app, ok := appMap[instance.App]
+		if !ok {
+			app = &entity.Application{
 				Name:      instance.App,
 				Instances: make([]*entity.Instance, 0),
 			}
-			app.Instances = append(app.Instances, instance)
 			appMap[instance.App] = app
 			appResource.Applications.ApplicationList = append(appResource.Applications.ApplicationList, app)
-		} else {
-			app := appMap[instance.App]
-			app.Instances = append(app.Instances, instance)
 		}
-		return true
-	})
+		app.Instances = append(app.Instances, instance)
+	}
 
 	appStore := appRepo.ApplicationStore
 	appStore.Range(func(key, value interface{}) bool {
@@ -93,54 +265,117 @@ func (appRepo *ApplicationRepository) GetApplicationResources() *entity.Applicat
 		appResource.Applications.ApplicationList = append(appResource.Applications.ApplicationList, app)
 		return true
 	})
-	return appResource
-
-}
 
-func (appRepo *ApplicationRepository) Renew(appName string, instanceId string) entity.Instance {
-	if value, ok := appRepo.ApplicationStore.Load(appName); ok {
-		app := value.(*entity.Application)
-		return *app.Instances[0]
+	// 排序以保证注册表未变化时序列化结果一致
+	sort.Slice(appResource.Applications.ApplicationList, func(i, j int) bool {
+		return appResource.Applications.ApplicationList[i].Name < appResource.Applications.ApplicationList[j].Name
+	})
+	for _, app := range appResource.Applications.ApplicationList {
+		sort.Slice(app.Instances, func(i, j int) bool {
+			return app.Instances[i].InstanceId < app.Instances[j].InstanceId
+		})
 	}
-	return entity.Instance{}
+	appResource.Applications.AppsHashcode = computeAppsHashcode(appResource.Applications.ApplicationList)
+	return appResource
 }
 
-func (appRepo *ApplicationRepository) GetInstanceIpsByService(service string) []string {
-	instances := make([]string, 0)
-
+// mergedInstances 合并 pod 生成的实例与自定义实例，自定义实例覆盖同 id 的 pod 实例
+func (appRepo *ApplicationRepository) mergedInstances() map[string]*entity.Instance {
+	instances := make(map[string]*entity.Instance)
+	appRepo.InstanceStore.Range(func(key, value interface{}) bool {
+		instances[key.(string)] = value.(*entity.Instance)
+		return true
+	})
 	appRepo.CustomInstanceStore.Range(func(key, value interface{}) bool {
-		instanceId := key.(string)
-		instance := value.(*entity.Instance)
-		appRepo.InstanceStore.Store(instanceId, instance)
+		instances[key.(string)] = value.(*entity.Instance)
 		return true
 	})
+	return instances
+}
 
-	appRepo.InstanceStore.Range(func(key, value interface{}) bool {
-		instance := value.(*entity.Instance)
-		if instance.App == service && instance.Status == "UP" {
-			instances = append(instances, instance.HomePageUrl)
+// GetApplication 按应用名查询应用，eureka 客户端使用大写的应用名，因此忽略大小写
+func (appRepo *ApplicationRepository) GetApplication(name string) *entity.Application {
+	for _, app := range appRepo.GetApplicationResources().Applications.ApplicationList {
+		if strings.EqualFold(app.Name, name) {
+			return app
 		}
-		return true
-	})
+	}
+	return nil
+}
+
+// GetApplicationResourcesByVip 返回 vip 地址与之匹配的实例，secure 为 true 时匹配 secureVipAddress。
+// 实例的 vip 地址可以是以逗号分隔的多个地址
+func (appRepo *ApplicationRepository) GetApplicationResourcesByVip(vip string, secure bool) *entity.ApplicationResources {
+	appResource := &entity.ApplicationResources{
+		Applications: &entity.Applications{
+			VersionsDelta:   appRepo.delta.currentVersion(),
+			ApplicationList: make([]*entity.Application, 0),
+		},
+	}
+	for _, app := range appRepo.GetApplicationResources().Applications.ApplicationList {
+		instances := make([]*entity.Instance, 0)
+		for _, instance := range app.Instances {
+			vipAddress := instance.VipAddress
+			if secure {
+				vipAddress = instance.SecureVipAddress
+			}
+			if matchVipAddress(vipAddress, vip) {
+				instances = append(instances, instance)
+			}
+		}
+		if len(instances) > 0 {
+			appResource.Applications.ApplicationList = append(appResource.Applications.ApplicationList,
+				&entity.Application{Name: app.Name, Instances: instances})
+		}
+	}
+	appResource.Applications.AppsHashcode = computeAppsHashcode(appResource.Applications.ApplicationList)
+	return appResource
+}
+
+func matchVipAddress(vipAddress string, vip string) bool {
+	for _, address := range strings.Split(vipAddress, ",") {
+		if strings.EqualFold(strings.TrimSpace(address), vip) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetInstance 按实例 id 查询实例，自定义的实例优先，实例状态叠加了健康检查的结果
+func (appRepo *ApplicationRepository) GetInstance(instanceId string) *entity.Instance {
+	if instance := appRepo.GetStoredInstance(instanceId); instance != nil {
+		return appRepo.applyHealth(instance)
+	}
+	return nil
+}
+
+// GetStoredInstance 返回存储中的实例，不叠加健康检查的结果，用于修改实例后再保存
+func (appRepo *ApplicationRepository) GetStoredInstance(instanceId string) *entity.Instance {
+	if value, ok := appRepo.CustomInstanceStore.Load(instanceId); ok {
+		return value.(*entity.Instance)
+	}
+	if value, ok := appRepo.InstanceStore.Load(instanceId); ok {
+		return value.(*entity.Instance)
+	}
+	return nil
+}
+
+func (appRepo *ApplicationRepository) GetInstanceIpsByService(service string) []string {
+	instances := make([]string, 0)
+	for _, instance := range appRepo.GetInstancesByService(service) {
+		instances = append(instances, instance.HomePageUrl)
+	}
 	return instances
 }
 
 func (appRepo *ApplicationRepository) GetInstancesByService(service string) []*entity.Instance {
 	instances := make([]*entity.Instance, 0)
-
-	appRepo.CustomInstanceStore.Range(func(key, value interface{}) bool {
-		instanceId := key.(string)
-		instance := value.(*entity.Instance)
-		appRepo.InstanceStore.Store(instanceId, instance)
-		return true
-	})
-
-	appRepo.InstanceStore.Range(func(key, value interface{}) bool {
-		instance := value.(*entity.Instance)
-		if instance.App == service && instance.Status == "UP" {
-			instances = append(instances, instance)
+	for _, app := range appRepo.GetApplicationResources().Applications.ApplicationList {
+		for _, instance := range app.Instances {
+			if instance.App == service && instance.Status == "UP" {
+				instances = append(instances, instance)
+			}
 		}
-		return true
-	})
+	}
 	return instances
 }
@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+	"github.com/golang/glog"
+)
+
+// Snapshot 是某一版本注册表的只读快照，包含预先序列化好的 json、xml 及其 gzip 压缩结果，
+// 注册表未变化时所有的全量拉取请求共享同一个快照
+type Snapshot struct {
+	Version   int
+	Resources *entity.ApplicationResources
+	Json      []byte
+	JsonGzip  []byte
+	JsonETag  string
+	Xml       []byte
+	XmlGzip   []byte
+	XmlETag   string
+}
+
+// GetSnapshot 返回当前版本的注册表快照，版本号变化后才会重新构建
+func (appRepo *ApplicationRepository) GetSnapshot() *Snapshot {
+	version := appRepo.delta.currentVersion()
+	if snapshot, ok := appRepo.snapshot.Load().(*Snapshot); ok && snapshot.Version == version {
+		return snapshot
+	}
+
+	appRepo.snapshotLock.Lock()
+	defer appRepo.snapshotLock.Unlock()
+	// 等待锁期间可能已有其它请求构建了新的快照
+	version = appRepo.delta.currentVersion()
+	if snapshot, ok := appRepo.snapshot.Load().(*Snapshot); ok && snapshot.Version == version {
+		return snapshot
+	}
+	snapshot := appRepo.buildSnapshot(version)
+	appRepo.snapshot.Store(snapshot)
+	return snapshot
+}
+
+// buildSnapshot 必须在读取版本号之后再读取存储，保证快照内容不旧于其版本号
+func (appRepo *ApplicationRepository) buildSnapshot(version int) *Snapshot {
+	resources := appRepo.buildApplicationResources(version)
+	snapshot := &Snapshot{
+		Version:   version,
+		Resources: resources,
+	}
+
+	jsonBytes, err := json.Marshal(resources)
+	if err != nil {
+		glog.Errorf("Marshal registry snapshot %d to json error: %v", version, err)
+	}
+	snapshot.Json = jsonBytes
+	snapshot.JsonGzip = gzipBytes(jsonBytes)
+	snapshot.JsonETag = eTag(jsonBytes)
+
+	xmlBytes, err := xml.Marshal(resources.Applications)
+	if err != nil {
+		glog.Errorf("Marshal registry snapshot %d to xml error: %v", version, err)
+	}
+	snapshot.Xml = append([]byte(xml.Header), xmlBytes...)
+	snapshot.XmlGzip = gzipBytes(snapshot.Xml)
+	snapshot.XmlETag = eTag(snapshot.Xml)
+	return snapshot
+}
+
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		glog.Errorf("Gzip registry snapshot error: %v", err)
+		return nil
+	}
+	if err := writer.Close(); err != nil {
+		glog.Errorf("Gzip registry snapshot error: %v", err)
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// eTag 使用内容的 sha1 作为弱 ETag，同一内容的 gzip 与非 gzip 响应共用
+func eTag(data []byte) string {
+	return fmt.Sprintf("W/\"%x\"", sha1.Sum(data))
+}
@@ -0,0 +1,32 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+)
+
+func TestGetSnapshot(t *testing.T) {
+	appRepo := NewApplicationRepository()
+	appRepo.Register(&entity.Instance{InstanceId: "10.0.0.1:test-service:8080", App: "test-service", Status: entity.UP}, "test/test-service-0")
+
+	snapshot := appRepo.GetSnapshot()
+	if appRepo.GetSnapshot() != snapshot {
+		t.Errorf("GetSnapshot should reuse the snapshot when registry not changed")
+	}
+
+	appRepo.SaveCustomInstance(&entity.Instance{InstanceId: "custom-0", App: "custom-service", Status: entity.UP})
+	changed := appRepo.GetSnapshot()
+	if changed == snapshot || changed.Version != snapshot.Version+1 {
+		t.Fatalf("GetSnapshot should rebuild after registry changed, version %d", changed.Version)
+	}
+	if len(changed.Resources.Applications.ApplicationList) != 2 {
+		t.Errorf("GetSnapshot expect 2 apps but %d", len(changed.Resources.Applications.ApplicationList))
+	}
+	if changed.JsonETag == snapshot.JsonETag || changed.XmlETag == snapshot.XmlETag {
+		t.Errorf("GetSnapshot ETag should change with the registry")
+	}
+	if _, ok := appRepo.InstanceStore.Load("custom-0"); ok {
+		t.Errorf("GetSnapshot should not copy custom instances into InstanceStore")
+	}
+}
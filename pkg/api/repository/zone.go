@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"sort"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+)
+
+// ZoneApplications 返回按可用区过滤与排序后的应用列表。zone 不为空时只保留该可用区的实例，
+// preferZone 不为空时该可用区的实例排在前面。applications 为共享的只读对象，不会被修改
+func ZoneApplications(applications *entity.Applications, zone string, preferZone string) *entity.Applications {
+	result := &entity.Applications{
+		VersionsDelta:   applications.VersionsDelta,
+		ApplicationList: make([]*entity.Application, 0, len(applications.ApplicationList)),
+	}
+	for _, app := range applications.ApplicationList {
+		if zoneApp := ZoneApplication(app, zone, preferZone); len(zoneApp.Instances) > 0 {
+			result.ApplicationList = append(result.ApplicationList, zoneApp)
+		}
+	}
+	result.AppsHashcode = computeAppsHashcode(result.ApplicationList)
+	return result
+}
+
+// ZoneApplication 返回按可用区过滤与排序后的应用，规则与 ZoneApplications 相同
+func ZoneApplication(app *entity.Application, zone string, preferZone string) *entity.Application {
+	instances := make([]*entity.Instance, 0, len(app.Instances))
+	for _, instance := range app.Instances {
+		if len(zone) == 0 || instanceZone(instance) == zone {
+			instances = append(instances, instance)
+		}
+	}
+	if len(preferZone) > 0 {
+		sort.SliceStable(instances, func(i, j int) bool {
+			return instanceZone(instances[i]) == preferZone && instanceZone(instances[j]) != preferZone
+		})
+	}
+	return &entity.Application{Name: app.Name, Instances: instances}
+}
+
+func instanceZone(instance *entity.Instance) string {
+	return instance.Metadata[entity.ZoneMetadataKey]
+}
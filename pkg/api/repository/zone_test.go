@@ -0,0 +1,33 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+)
+
+func TestZoneApplications(t *testing.T) {
+	appRepo := NewApplicationRepository()
+	appRepo.Register(&entity.Instance{InstanceId: "10.0.0.1:test-service:8080", App: "test-service", Status: entity.UP,
+		Metadata: entity.Metadata{entity.ZoneMetadataKey: "zone-b"}}, "test/test-service-0")
+	appRepo.Register(&entity.Instance{InstanceId: "10.0.0.2:test-service:8080", App: "test-service", Status: entity.UP,
+		Metadata: entity.Metadata{entity.ZoneMetadataKey: "zone-a"}}, "test/test-service-1")
+	appRepo.Register(&entity.Instance{InstanceId: "10.0.0.3:other-service:8080", App: "other-service", Status: entity.UP,
+		Metadata: entity.Metadata{}}, "test/other-service-0")
+	applications := appRepo.GetApplicationResources().Applications
+
+	filtered := ZoneApplications(applications, "zone-a", "")
+	if len(filtered.ApplicationList) != 1 || len(filtered.ApplicationList[0].Instances) != 1 ||
+		filtered.ApplicationList[0].Instances[0].InstanceId != "10.0.0.2:test-service:8080" {
+		t.Errorf("ZoneApplications should keep the instances in zone-a only: %+v", filtered.ApplicationList)
+	}
+
+	preferred := ZoneApplication(appRepo.GetApplication("test-service"), "", "zone-b")
+	if len(preferred.Instances) != 2 || preferred.Instances[0].InstanceId != "10.0.0.1:test-service:8080" {
+		t.Errorf("ZoneApplication should put the instances in zone-b first: %+v", preferred.Instances)
+	}
+	if applications.ApplicationList[1].Instances[0].InstanceId != "10.0.0.1:test-service:8080" ||
+		len(applications.ApplicationList) != 2 {
+		t.Errorf("ZoneApplications should not modify the shared applications")
+	}
+}
@@ -1,6 +1,7 @@
 package router
 
 import (
+	"github.com/choerodon/go-register-server/pkg/api/entity"
 	"github.com/choerodon/go-register-server/pkg/api/service"
 	"github.com/choerodon/go-register-server/pkg/embed"
 	"github.com/choerodon/go-register-server/pkg/k8s"
@@ -10,7 +11,7 @@ import (
 	"path"
 )
 
-func Register() {
+func Register(stopCh <-chan struct{}) {
 	rs := service.NewEurekaServerServiceImpl(k8s.AppRepo)
 
 	ps := service.NewEurekaPageServiceImpl(k8s.AppRepo)
@@ -19,6 +20,10 @@ func Register() {
 
 	rs.InitCustomAppFromConfigMap()
 
+	go rs.StartEvictor(stopCh)
+
+	go service.NewHealthChecker(k8s.AppRepo).Start(stopCh)
+
 	ws := new(restful.WebService)
 
 	ws.Path("/").Produces(restful.MIME_JSON, restful.MIME_XML)
@@ -31,12 +36,46 @@ func Register() {
 
 	ws.Route(ws.GET("/static").To(staticFromQueryParam))
 
+	// 当前监听的 namespace 及监听的原因
+	ws.Route(ws.GET("admin/namespaces").To(ps.Namespaces).
+		Doc("List watched namespaces").Produces(restful.MIME_JSON).
+		Writes([]entity.WatchedNamespace{}))
+
 	// 获取eureka注册信息、模拟注册、心跳接口
 	ws.Route(ws.GET("eureka/apps").To(rs.Apps).
-		Doc("Get all apps")).Produces("application/json")
+		Doc("Get all apps").Produces(restful.MIME_JSON, restful.MIME_XML).
+		Param(ws.QueryParameter("zone", "only return the instances in the zone").DataType("string")).
+		Param(ws.QueryParameter("preferZone", "return the instances in the zone first").DataType("string")))
 
 	ws.Route(ws.GET("eureka/apps/delta").To(rs.AppsDelta).
-		Doc("Get all apps delta")).Produces("application/json")
+		Doc("Get all apps delta").Produces(restful.MIME_JSON, restful.MIME_XML))
+
+	ws.Route(ws.GET("eureka/apps/{app-name}").To(rs.App).
+		Doc("Get a app").Produces(restful.MIME_JSON, restful.MIME_XML).
+		Param(ws.PathParameter("app-name", "app name").DataType("string")).
+		Param(ws.QueryParameter("zone", "only return the instances in the zone").DataType("string")).
+		Param(ws.QueryParameter("preferZone", "return the instances in the zone first").DataType("string")))
+
+	ws.Route(ws.GET("eureka/apps/{app-name}/{instance-id}").To(rs.AppInstance).
+		Doc("Get a instance of app").Produces(restful.MIME_JSON, restful.MIME_XML).
+		Param(ws.PathParameter("app-name", "app name").DataType("string")).
+		Param(ws.PathParameter("instance-id", "instance id").DataType("string")))
+
+	ws.Route(ws.GET("eureka/instances/{instance-id}").To(rs.Instance).
+		Doc("Get a instance").Produces(restful.MIME_JSON, restful.MIME_XML).
+		Param(ws.PathParameter("instance-id", "instance id").DataType("string")))
+
+	ws.Route(ws.GET("eureka/vips/{vip-address}").To(rs.Vips).
+		Doc("Get instances by vip address").Produces(restful.MIME_JSON, restful.MIME_XML).
+		Param(ws.PathParameter("vip-address", "vip address").DataType("string")).
+		Param(ws.QueryParameter("zone", "only return the instances in the zone").DataType("string")).
+		Param(ws.QueryParameter("preferZone", "return the instances in the zone first").DataType("string")))
+
+	ws.Route(ws.GET("eureka/svips/{svip-address}").To(rs.Svips).
+		Doc("Get instances by secure vip address").Produces(restful.MIME_JSON, restful.MIME_XML).
+		Param(ws.PathParameter("svip-address", "secure vip address").DataType("string")).
+		Param(ws.QueryParameter("zone", "only return the instances in the zone").DataType("string")).
+		Param(ws.QueryParameter("preferZone", "return the instances in the zone first").DataType("string")))
 
 	ws.Route(ws.POST("eureka/apps/{app-name}").To(rs.Register).
 		Doc("Register a app").Produces("application/json").
@@ -52,9 +91,31 @@ func Register() {
 		Param(ws.PathParameter("app-name", "app name").DataType("string")).
 		Param(ws.PathParameter("instance-id", "instance id").DataType("string")))
 
+	ws.Route(ws.PUT("eureka/apps/{app-name}/{instance-id}/status").To(rs.StatusUpdate).
+		Doc("Override instance status").
+		Param(ws.PathParameter("app-name", "app name").DataType("string")).
+		Param(ws.PathParameter("instance-id", "instance id").DataType("string")).
+		Param(ws.QueryParameter("value", "overridden status, such as OUT_OF_SERVICE").DataType("string")))
+
+	ws.Route(ws.DELETE("eureka/apps/{app-name}/{instance-id}/status").To(rs.DeleteStatusOverride).
+		Doc("Delete instance status override").
+		Param(ws.PathParameter("app-name", "app name").DataType("string")).
+		Param(ws.PathParameter("instance-id", "instance id").DataType("string")).
+		Param(ws.QueryParameter("value", "status after override removed, default UP").DataType("string")))
+
+	ws.Route(ws.PUT("eureka/apps/{app-name}/{instance-id}/metadata").To(rs.UpdateInstanceMetadata).
+		Doc("Update metadata of a instance by query parameters").
+		Param(ws.PathParameter("app-name", "app name").DataType("string")).
+		Param(ws.PathParameter("instance-id", "instance id").DataType("string")))
+
 	ws.Route(ws.PUT("eureka/apps/metadata").To(rs.UpdateMateData).
 		Doc("Update matedata").Produces("application/json").
-		Param(ws.PathParameter("instance-id", "instance id").DataType("string")))
+		Param(ws.BodyParameter("metadata", "map of instance id to metadata").DataType("map[string]map[string]string")))
+
+	// 接收其它副本批量复制的注册、心跳、下线与覆盖状态操作
+	ws.Route(ws.POST("eureka/peerreplication/batch").To(rs.PeerReplicationBatch).
+		Doc("Batch replication from peers").Produces(restful.MIME_JSON).
+		Reads(entity.ReplicationList{}).Writes(entity.ReplicationListResponse{}))
 
 	if embed.Env.ConfigServer.Enabled {
 		cs := service.NewConfigServiceImpl(k8s.AppRepo)
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"fmt"
+	"github.com/choerodon/go-register-server/pkg/api/entity"
 	"github.com/choerodon/go-register-server/pkg/api/router"
 	"net/http"
 
@@ -30,12 +32,12 @@ func (s *RegisterServer) PrepareRun() *PreparedRegisterServer {
 
 func (s *PreparedRegisterServer) Run(stopCh <-chan struct{}) error {
 
-	router.Register()
+	router.Register(stopCh)
 
 	http.Handle("/metrics", promhttp.Handler())
 
 	go func() {
-		glog.Fatal(http.ListenAndServe(":8000", nil))
+		glog.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", entity.RegisterServerPort), nil))
 	}()
 
 	glog.Info("Started server")
@@ -14,6 +14,7 @@ import (
 	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/go-playground/validator.v9"
+	"k8s.io/client-go/util/retry"
 	"net/http"
 	"reflect"
 	"strconv"
@@ -48,54 +49,19 @@ func (es *ConfigServiceImpl) Delete(request *restful.Request, response *restful.
 	dto := new(entity.ZuulRootDTO)
 	err := request.ReadEntity(&dto)
 	if err != nil {
-		glog.Warningf("Delete zuul-route failed when readEntity", err)
+		glog.Warningf("Delete zuul-route failed when readEntity: %v", err)
 		_ = response.WriteErrorString(http.StatusBadRequest, "invalid ZuulRootDTO")
 		return
 	}
 	err = es.validate.Struct(dto)
 	if err != nil {
-		glog.Warningf("Delete zuul-route failed because of invalid ZuulRootDTO", err)
+		glog.Warningf("Delete zuul-route failed because of invalid ZuulRootDTO: %v", err)
 		_ = response.WriteErrorString(http.StatusBadRequest, "invalid ZuulRootDTO")
 		return
 	}
-	configMap, namespace := es.configMapOperator.QueryConfigMapAndNamespaceByName(entity.RouteConfigMap)
-	if configMap == nil {
-		glog.Warningf("Delete zuul-route failed because of can not find config map : zuul-route", err)
-		_ = response.WriteErrorString(http.StatusNotFound, "not found zuul-route")
-		return
-	}
-	version := configMap.ObjectMeta.Annotations[entity.ChoerodonVersion]
-
-	profileKey := utils.ConfigMapProfileKey(entity.DefaultProfile)
-	oldYaml := configMap.Data[profileKey]
-	source := make(map[string]interface{})
-	if oldYaml == "" {
-		glog.Warningf("zuul-route yaml is empty", err)
-		_ = response.WriteErrorString(http.StatusBadRequest, "empty zuul-route")
-		return
-	}
-	err = yaml.Unmarshal([]byte(oldYaml), &source)
-	if err != nil {
-		glog.Warningf("yaml convert to map error", err)
-		_ = response.WriteErrorString(http.StatusBadRequest, "error to convert yaml to map")
-		return
-	}
-
-	zuulMap := source[entity.ZuulNode].(map[string]interface{})
-	routesMap := zuulMap[entity.RoutesNode].(map[string]interface{})
-
-	name := dto.Name
-	if _, ok := routesMap[name]; ok {
-		delete(routesMap, name)
-	}
-	zuulMap = map[string]interface{}{"zuul": zuulMap}
-	zuulYaml, err := yaml.Marshal(zuulMap)
-	if err != nil {
-		glog.Warningf("map to yaml error", err)
-		_ = response.WriteErrorString(http.StatusBadRequest, "error to convert map to yaml")
-		return
-	}
-	es.saveOrUpdate(version, namespace, zuulYaml, response)
+	es.modifyZuulRoutes(response, func(routesMap map[string]interface{}) {
+		delete(routesMap, dto.Name)
+	})
 }
 
 func (es *ConfigServiceImpl) AddOrUpdate(request *restful.Request, response *restful.Response) {
@@ -103,85 +69,94 @@ func (es *ConfigServiceImpl) AddOrUpdate(request *restful.Request, response *res
 	dto := new(entity.ZuulRootDTO)
 	err := request.ReadEntity(&dto)
 	if err != nil {
-		glog.Warningf("Add or update zuul-route failed when readEntity", err)
+		glog.Warningf("Add or update zuul-route failed when readEntity: %v", err)
 		_ = response.WriteErrorString(http.StatusBadRequest, "invalid ZuulRootDTO")
 		return
 	}
 	err = es.validate.Struct(dto)
 	if err != nil {
-		glog.Warningf("Add or update zuul-route failed because of invalid ZuulRootDTO", err)
+		glog.Warningf("Add or update zuul-route failed because of invalid ZuulRootDTO: %v", err)
 		_ = response.WriteErrorString(http.StatusBadRequest, "invalid ZuulRootDTO")
 		return
 	}
-	configMap, namespace := es.configMapOperator.QueryConfigMapAndNamespaceByName(entity.RouteConfigMap)
-	if configMap == nil {
-		glog.Warningf("Add or update zuul-route failed because of can not find config map : zuul-route", err)
-		_ = response.WriteErrorString(http.StatusNotFound, "not found zuul-route")
-		return
-	}
-	version := configMap.ObjectMeta.Annotations[entity.ChoerodonVersion]
+	es.modifyZuulRoutes(response, func(routesMap map[string]interface{}) {
+		//已存在，更新
+		if val, ok := routesMap[dto.Name]; ok {
+			es.dto2map(val.(map[string]interface{}), dto)
+			return
+		}
+		//不存在，新建
+		route := make(map[string]interface{})
+		es.dto2map(route, dto)
+		routesMap[dto.Name] = route
+	})
+}
 
-	profileKey := utils.ConfigMapProfileKey(entity.DefaultProfile)
-	oldYaml := configMap.Data[profileKey]
-	source := make(map[string]interface{})
-	if oldYaml == "" {
-		glog.Warningf("zuul-route yaml is empty", err)
-		_ = response.WriteErrorString(http.StatusBadRequest, "empty zuul-route")
-		return
-	}
-	err = yaml.Unmarshal([]byte(oldYaml), &source)
-	if err != nil {
-		glog.Warningf("yaml convert to map error", err)
-		_ = response.WriteErrorString(http.StatusBadRequest, "error to convert yaml to map")
-		return
-	}
+// zuulRouteError 修改 zuul-route 失败时返回给客户端的状态码与信息
+type zuulRouteError struct {
+	statusCode int
+	message    string
+}
 
-	zuulMap := source[entity.ZuulNode].(map[string]interface{})
-	routesMap := zuulMap[entity.RoutesNode].(map[string]interface{})
+func (e *zuulRouteError) Error() string {
+	return e.message
+}
+
+// modifyZuulRoutes 读取 zuul-route 中的路由并修改后保存。多个副本可能同时修改，
+// 保存时携带读取到的 resourceVersion，冲突时重新读取并重试，避免覆盖其它副本的修改
+func (es *ConfigServiceImpl) modifyZuulRoutes(response *restful.Response, modify func(routesMap map[string]interface{})) {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, namespace := es.configMapOperator.QueryConfigMapAndNamespaceByName(entity.RouteConfigMap)
+		if configMap == nil {
+			glog.Warning("Modify zuul-route failed because of can not find config map : zuul-route")
+			return &zuulRouteError{http.StatusNotFound, "not found zuul-route"}
+		}
+		version, _ := k8s.LabelKeys().LookupVersion(configMap.ObjectMeta.Annotations)
+
+		profileKey := utils.ConfigMapProfileKey(entity.DefaultProfile)
+		oldYaml := configMap.Data[profileKey]
+		source := make(map[string]interface{})
+		if oldYaml == "" {
+			glog.Warning("zuul-route yaml is empty")
+			return &zuulRouteError{http.StatusBadRequest, "empty zuul-route"}
+		}
+		err := yaml.Unmarshal([]byte(oldYaml), &source)
+		if err != nil {
+			glog.Warningf("yaml convert to map error: %v", err)
+			return &zuulRouteError{http.StatusBadRequest, "error to convert yaml to map"}
+		}
+
+		zuulMap := source[entity.ZuulNode].(map[string]interface{})
+		routesMap := zuulMap[entity.RoutesNode].(map[string]interface{})
+		modify(routesMap)
 
-	//已存在，更新
-	if val, ok := routesMap[dto.Name]; ok {
-		route := val.(map[string]interface{})
-		es.dto2map(route, dto)
 		zuulMap = map[string]interface{}{"zuul": zuulMap}
 		zuulYaml, err := yaml.Marshal(zuulMap)
 		if err != nil {
-			glog.Warningf("map to yaml error", err)
-			_ = response.WriteErrorString(http.StatusBadRequest, "error to convert map to yaml")
-			return
+			glog.Warningf("map to yaml error: %v", err)
+			return &zuulRouteError{http.StatusBadRequest, "error to convert map to yaml"}
+		}
+		saveConfigDTO := &entity.SaveConfigDTO{
+			Service:         entity.RouteConfigMap,
+			Version:         version,
+			Profile:         entity.DefaultProfile,
+			Namespace:       namespace,
+			UpdatePolicy:    entity.UpdatePolicyOverride,
+			Yaml:            string(zuulYaml),
+			ResourceVersion: configMap.ResourceVersion,
 		}
-		es.saveOrUpdate(version, namespace, zuulYaml, response)
+		_, err = es.configMapOperator.UpdateConfigMap(saveConfigDTO)
+		return err
+	})
+	if err == nil {
 		return
 	}
-	//不存在，新建
-	route := make(map[string]interface{})
-	es.dto2map(route, dto)
-	routesMap[dto.Name] = route
-
-	zuulMap = map[string]interface{}{"zuul": zuulMap}
-	zuulYaml, err := yaml.Marshal(zuulMap)
-	if err != nil {
-		glog.Warningf("map to yaml error", err)
-		_ = response.WriteErrorString(http.StatusBadRequest, "error to convert map to yaml")
+	if routeErr, ok := err.(*zuulRouteError); ok {
+		_ = response.WriteErrorString(routeErr.statusCode, routeErr.message)
 		return
 	}
-	es.saveOrUpdate(version, namespace, zuulYaml, response)
-}
-
-func (es *ConfigServiceImpl) saveOrUpdate(version string, namespace string, zuulYaml []byte, response *restful.Response) {
-	saveConfigDTO := &entity.SaveConfigDTO{
-		Service:      entity.RouteConfigMap,
-		Version:      version,
-		Profile:      entity.DefaultProfile,
-		Namespace:    namespace,
-		UpdatePolicy: entity.UpdatePolicyOverride,
-		Yaml:         string(zuulYaml),
-	}
-	_, err := es.configMapOperator.UpdateConfigMap(saveConfigDTO)
-	if err != nil {
-		glog.Warningf("Save config failed when update configMap", err)
-		_ = response.WriteErrorString(http.StatusInternalServerError, "update configMap failed")
-	}
+	glog.Warningf("Save config failed when update configMap: %v", err)
+	_ = response.WriteErrorString(http.StatusInternalServerError, "update configMap failed")
 }
 
 func (es *ConfigServiceImpl) dto2map(route map[string]interface{}, dto *entity.ZuulRootDTO) {
@@ -203,20 +178,20 @@ func (es *ConfigServiceImpl) Save(request *restful.Request, response *restful.Re
 	dto := new(entity.SaveConfigDTO)
 	err := request.ReadEntity(&dto)
 	if err != nil {
-		glog.Warningf("Save config failed when readEntity", err)
+		glog.Warningf("Save config failed when readEntity: %v", err)
 		_ = response.WriteErrorString(http.StatusBadRequest, "invalid saveConfigDTO")
 		return
 	}
 	err = es.validate.Struct(dto)
 	if err != nil {
-		glog.Warningf("Save config failed cause of invalid saveConfigDTO", err)
+		glog.Warningf("Save config failed cause of invalid saveConfigDTO: %v", err)
 		_ = response.WriteErrorString(http.StatusBadRequest, "invalid saveConfigDTO")
 		return
 	}
 	source := make(map[string]interface{})
 	err = yaml.Unmarshal([]byte(dto.Yaml), &source)
 	if err != nil {
-		glog.Warningf("Save config failed cause of invalid yaml", err)
+		glog.Warningf("Save config failed cause of invalid yaml: %v", err)
 		_ = response.WriteErrorString(http.StatusBadRequest, "invalid yaml")
 		return
 	}
@@ -224,7 +199,7 @@ func (es *ConfigServiceImpl) Save(request *restful.Request, response *restful.Re
 	if dto.Service == entity.ApiGatewayServiceName {
 		gb, rb, rm, err := separateRoute(source)
 		if err != nil {
-			glog.Warningf("Save config failed when separateRoute", err)
+			glog.Warningf("Save config failed when separateRoute: %v", err)
 			_ = response.WriteErrorString(http.StatusInternalServerError, "separateRoute error")
 			return
 		}
@@ -248,7 +223,7 @@ func (es *ConfigServiceImpl) createOrUpdateConfigMap(dto *entity.SaveConfigDTO,
 		var err error
 		queryConfigMap, err = es.configMapOperator.CreateConfigMap(dto)
 		if err != nil {
-			glog.Warningf("Save config failed when create configMap", err)
+			glog.Warningf("Save config failed when create configMap: %v", err)
 			_ = response.WriteErrorString(http.StatusInternalServerError, "create configMap failed")
 			return
 		}
@@ -267,7 +242,7 @@ func (es *ConfigServiceImpl) createOrUpdateConfigMap(dto *entity.SaveConfigDTO,
 		if oldYaml != "" {
 			newYaml, err := processProperty(oldYaml, source, entity.AddProperty)
 			if err != nil {
-				glog.Warningf("Save config failed when merge yaml", err)
+				glog.Warningf("Save config failed when merge yaml: %v", err)
 				_ = response.WriteErrorString(http.StatusInternalServerError, "merge yaml failed")
 				return
 			}
@@ -280,7 +255,7 @@ func (es *ConfigServiceImpl) createOrUpdateConfigMap(dto *entity.SaveConfigDTO,
 		if oldYaml != "" {
 			mergedYaml, err := processProperty(oldYaml, source, entity.MergeProperty)
 			if err != nil {
-				glog.Warningf("Save config failed when merge yaml", err)
+				glog.Warningf("Save config failed when merge yaml: %v", err)
 				_ = response.WriteErrorString(http.StatusInternalServerError, "merge yaml failed")
 				return
 			}
@@ -291,7 +266,7 @@ func (es *ConfigServiceImpl) createOrUpdateConfigMap(dto *entity.SaveConfigDTO,
 	if dto.UpdatePolicy != entity.UpdatePolicyNot {
 		_, err := es.configMapOperator.UpdateConfigMap(dto)
 		if err != nil {
-			glog.Warningf("Save config failed when update configMap", err)
+			glog.Warningf("Save config failed when update configMap: %v", err)
 			_ = response.WriteErrorString(http.StatusInternalServerError, "update configMap failed")
 			return
 		}
@@ -313,14 +288,14 @@ func (es *ConfigServiceImpl) Poll(request *restful.Request, response *restful.Re
 	kvMap, configMapVersion, err := es.getConfigFromConfigMap(service, version)
 	if err != nil {
 		_ = response.WriteErrorString(http.StatusNotFound, "can't find correct configMap")
-		glog.Warningf("Get config from configMap failed, service: %s", service, err)
+		glog.Warningf("Get config from configMap failed, service: %s, error: %v", service, err)
 		return
 	}
 	if isGateway(service) {
 		routeMap, _, err := es.getConfigFromConfigMap(entity.RouteConfigMap, version)
 		if err != nil {
 			_ = response.WriteErrorString(http.StatusNotFound, "can't find zuul-route configMap")
-			glog.Warningf("Get zuul-route from configMap failed", err)
+			glog.Warningf("Get zuul-route from configMap failed: %v", err)
 			return
 		}
 		// 如果是api-gateway或者gateway-helper，则删除他们配置里的路由配置，添加'zuul-route'configMap里的路由配置
@@ -346,7 +321,7 @@ func (es *ConfigServiceImpl) Poll(request *restful.Request, response *restful.Re
 	}
 	err = response.WriteAsJson(env)
 	if err != nil {
-		glog.Warningf("GetConfig write apps.Environment as json error,  msg : %s", env, err)
+		glog.Warningf("GetConfig write apps.Environment as json error,  msg : %v, error: %v", env, err)
 	}
 }
 
@@ -398,7 +373,8 @@ func (es *ConfigServiceImpl) getConfigFromConfigMap(service string, version stri
 		}
 	}
 
-	return utils.ConvertRecursiveMapToSingleMap(source), configMap.Annotations[entity.ChoerodonVersion], nil
+	configVersion, _ := k8s.LabelKeys().LookupVersion(configMap.Annotations)
+	return utils.ConvertRecursiveMapToSingleMap(source), configVersion, nil
 }
 
 func isGateway(service string) bool {
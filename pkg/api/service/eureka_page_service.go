@@ -5,6 +5,7 @@ import (
 	"github.com/choerodon/go-register-server/pkg/api/metrics"
 	"github.com/choerodon/go-register-server/pkg/api/repository"
 	"github.com/choerodon/go-register-server/pkg/embed"
+	"github.com/choerodon/go-register-server/pkg/k8s"
 	"github.com/emicklei/go-restful"
 	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
@@ -12,6 +13,7 @@ import (
 	"net"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -31,18 +33,31 @@ func (es *EurekaPageServiceImpl) HomePage(req *restful.Request, resp *restful.Re
 	metrics.RequestCount.With(prometheus.Labels{"path": req.Request.RequestURI}).Inc()
 	t := template.Must(template.ParseFiles("templates/eureka.html"))
 	register, eurekaInstances := getEurekaApplicationInfos(es.appRepo.GetApplicationResources().Applications.ApplicationList)
+	generalInfo := getGeneralInfo()
+	preservationMode, renewsLastMin, threshold := selfPreservation(es.appRepo)
+	generalInfo["RenewsLastMin"] = renewsLastMin
+	generalInfo["RenewsThreshold"] = threshold
+	generalInfo["HealthCheckEnabled"] = embed.Env.Eureka.Health.Enabled
+	generalInfo["UnhealthyInstances"] = es.appRepo.CountUnhealthyInstances()
 	err := t.Execute(resp.ResponseWriter, &entity.EurekaPage{
-		GeneralInfo:        getGeneralInfo(),
-		InstanceInfo:       getInstanceInfo(),
-		CurrentTime:        time.Now(),
-		AvailableRegisters: register,
-		EurekaInstances:    eurekaInstances,
+		GeneralInfo:          generalInfo,
+		InstanceInfo:         getInstanceInfo(),
+		CurrentTime:          time.Now(),
+		AvailableRegisters:   register,
+		EurekaInstances:      eurekaInstances,
+		SelfPreservationMode: preservationMode,
 	})
 	if err != nil {
 		glog.Fatalf("Error Get Home Page: %s", err.Error())
 	}
 }
 
+// Namespaces 返回当前监听的 namespace 及监听的原因
+func (es *EurekaPageServiceImpl) Namespaces(req *restful.Request, resp *restful.Response) {
+	metrics.RequestCount.With(prometheus.Labels{"path": req.Request.RequestURI}).Inc()
+	_ = resp.WriteAsJson(k8s.WatchedNamespaces())
+}
+
 func instanceHtml(instances []*entity.Instance) template.HTML {
 	html := ""
 	for i := 0; i < len(instances); i++ {
@@ -66,19 +81,25 @@ func bToMb(b uint64) int {
 	return int(b) / 1024 / 1024
 }
 
-func getIP() string {
+// getIPs 返回本机的 IPv4 与 IPv6 地址，IPv4 在前，忽略回环与链路本地地址
+func getIPs() string {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		return ""
 	}
+	ipv4s, ipv6s := make([]string, 0), make([]string, 0)
 	for _, address := range addrs {
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				return ipnet.IP.String()
-			}
+		ipnet, ok := address.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			ipv4s = append(ipv4s, ipnet.IP.String())
+		} else {
+			ipv6s = append(ipv6s, ipnet.IP.String())
 		}
 	}
-	return ""
+	return strings.Join(append(ipv4s, ipv6s...), ", ")
 }
 
 func getGeneralInfo() map[string]interface{} {
@@ -86,13 +107,13 @@ func getGeneralInfo() map[string]interface{} {
 	info["NumOfCpu"] = getCpuNum()
 	info["UsedMemory"] = getMemUsage()
 	info["NamespaceOfRegisterServer"] = embed.Env.RegisterServerNamespace
-	info["NamespacesOfListeningOn"] = embed.Env.RegisterServiceNamespace
+	info["NamespacesOfListeningOn"] = k8s.WatchedNamespaceNames()
 	return info
 }
 
 func getInstanceInfo() map[string]interface{} {
 	info := make(map[string]interface{})
-	info["IpAddr"] = getIP()
+	info["IpAddr"] = getIPs()
 	return info
 }
 
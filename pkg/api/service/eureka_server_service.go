@@ -15,8 +15,10 @@ import (
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/tools/cache"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -24,15 +26,25 @@ import (
 type EurekaServerService interface {
 	Apps(request *restful.Request, response *restful.Response)
 	AppsDelta(request *restful.Request, response *restful.Response)
+	App(request *restful.Request, response *restful.Response)
+	AppInstance(request *restful.Request, response *restful.Response)
+	Instance(request *restful.Request, response *restful.Response)
+	Vips(request *restful.Request, response *restful.Response)
+	Svips(request *restful.Request, response *restful.Response)
 	Register(request *restful.Request, response *restful.Response)
 	Delete(request *restful.Request, response *restful.Response)
 	Renew(request *restful.Request, response *restful.Response)
 	UpdateMateData(request *restful.Request, response *restful.Response)
+	UpdateInstanceMetadata(request *restful.Request, response *restful.Response)
+	StatusUpdate(request *restful.Request, response *restful.Response)
+	DeleteStatusOverride(request *restful.Request, response *restful.Response)
+	PeerReplicationBatch(request *restful.Request, response *restful.Response)
 }
 type EurekaServerServiceImpl struct {
 	appRepo           *repository.ApplicationRepository
 	configMapOperator k8s.ConfigMapOperator
 	podOperator       k8s.PodOperatorInterface
+	peerNodes         *k8s.PeerNodes
 }
 
 func NewEurekaServerServiceImpl(appRepo *repository.ApplicationRepository) *EurekaServerServiceImpl {
@@ -40,6 +52,7 @@ func NewEurekaServerServiceImpl(appRepo *repository.ApplicationRepository) *Eure
 		appRepo:           appRepo,
 		configMapOperator: k8s.NewConfigMapOperator(),
 		podOperator:       k8s.NewPodAgent(),
+		peerNodes:         k8s.NewPeerNodes(),
 	}
 	return s
 }
@@ -48,8 +61,12 @@ func (es *EurekaServerServiceImpl) Apps(request *restful.Request, response *rest
 	start := time.Now()
 
 	metrics.RequestCount.With(prometheus.Labels{"path": request.Request.RequestURI}).Inc()
-	applicationResources := es.appRepo.GetApplicationResources()
-	_ = response.WriteAsJson(applicationResources)
+	if zone, preferZone, ok := zoneQuery(request); ok {
+		applications := repository.ZoneApplications(es.appRepo.GetApplicationResources().Applications, zone, preferZone)
+		writeEurekaEntity(request, response, &entity.ApplicationResources{Applications: applications}, applications)
+	} else {
+		writeSnapshot(request, response, es.appRepo.GetSnapshot())
+	}
 
 	finish := time.Now()
 	cost := finish.Sub(start).Nanoseconds()
@@ -57,20 +74,134 @@ func (es *EurekaServerServiceImpl) Apps(request *restful.Request, response *rest
 	metrics.FetchProcessTime.Set(float64(cost))
 }
 
-func (es *EurekaServerServiceImpl) AppsDelta(request *restful.Request, response *restful.Response) {
+// App 查询单个应用
+func (es *EurekaServerServiceImpl) App(request *restful.Request, response *restful.Response) {
+	metrics.RequestCount.With(prometheus.Labels{"path": request.Request.RequestURI}).Inc()
+
+	appName := request.PathParameter("app-name")
+	app := es.appRepo.GetApplication(appName)
+	if app == nil {
+		_ = response.WriteErrorString(http.StatusNotFound, fmt.Sprintf("application %s not found", appName))
+		return
+	}
+	if zone, preferZone, ok := zoneQuery(request); ok {
+		app = repository.ZoneApplication(app, zone, preferZone)
+	}
+	writeEurekaEntity(request, response, &entity.ApplicationResource{Application: app}, app)
+}
+
+// AppInstance 查询应用下的单个实例
+func (es *EurekaServerServiceImpl) AppInstance(request *restful.Request, response *restful.Response) {
+	metrics.RequestCount.With(prometheus.Labels{"path": request.Request.RequestURI}).Inc()
+
+	appName := request.PathParameter("app-name")
+	instanceId := request.PathParameter("instance-id")
+	instance := es.appRepo.GetInstance(instanceId)
+	if instance == nil || !strings.EqualFold(instance.App, appName) {
+		_ = response.WriteErrorString(http.StatusNotFound, fmt.Sprintf("instance %s not found", instanceId))
+		return
+	}
+	writeEurekaEntity(request, response, &entity.InstanceResource{Instance: instance}, instance)
+}
+
+// Instance 按实例 id 查询实例
+func (es *EurekaServerServiceImpl) Instance(request *restful.Request, response *restful.Response) {
+	metrics.RequestCount.With(prometheus.Labels{"path": request.Request.RequestURI}).Inc()
+
+	instanceId := request.PathParameter("instance-id")
+	instance := es.appRepo.GetInstance(instanceId)
+	if instance == nil {
+		_ = response.WriteErrorString(http.StatusNotFound, fmt.Sprintf("instance %s not found", instanceId))
+		return
+	}
+	writeEurekaEntity(request, response, &entity.InstanceResource{Instance: instance}, instance)
+}
+
+// Vips 查询 vip 地址匹配的实例
+func (es *EurekaServerServiceImpl) Vips(request *restful.Request, response *restful.Response) {
+	metrics.RequestCount.With(prometheus.Labels{"path": request.Request.RequestURI}).Inc()
+	applicationResources := es.appRepo.GetApplicationResourcesByVip(request.PathParameter("vip-address"), false)
+	if zone, preferZone, ok := zoneQuery(request); ok {
+		applicationResources.Applications = repository.ZoneApplications(applicationResources.Applications, zone, preferZone)
+	}
+	writeEurekaEntity(request, response, applicationResources, applicationResources.Applications)
+}
+
+// Svips 查询 secure vip 地址匹配的实例
+func (es *EurekaServerServiceImpl) Svips(request *restful.Request, response *restful.Response) {
 	metrics.RequestCount.With(prometheus.Labels{"path": request.Request.RequestURI}).Inc()
-	applicationResources := &entity.ApplicationResources{
-		Applications: &entity.Applications{
-			VersionsDelta:   2,
-			AppsHashcode:    "app_hashcode",
-			ApplicationList: make([]*entity.Application, 0),
-		},
+	applicationResources := es.appRepo.GetApplicationResourcesByVip(request.PathParameter("svip-address"), true)
+	if zone, preferZone, ok := zoneQuery(request); ok {
+		applicationResources.Applications = repository.ZoneApplications(applicationResources.Applications, zone, preferZone)
 	}
-	_ = response.WriteAsJson(applicationResources)
+	writeEurekaEntity(request, response, applicationResources, applicationResources.Applications)
+}
+
+func (es *EurekaServerServiceImpl) AppsDelta(request *restful.Request, response *restful.Response) {
+	metrics.RequestCount.With(prometheus.Labels{"path": request.Request.RequestURI}).Inc()
+	applicationResources := es.appRepo.GetApplicationDelta()
+	writeEurekaEntity(request, response, applicationResources, applicationResources.Applications)
 }
 
 func (es *EurekaServerServiceImpl) Renew(request *restful.Request, response *restful.Response) {
 	metrics.RequestCount.With(prometheus.Labels{"path": request.Request.RequestURI}).Inc()
+
+	instanceId := request.PathParameter("instance-id")
+	// 实例不存在时返回 404，客户端收到后会重新注册
+	if !es.appRepo.Renew(instanceId) {
+		glog.Warningf("Renew instance %s not found", instanceId)
+		response.WriteHeader(http.StatusNotFound)
+		return
+	}
+	es.replicate(request, &entity.ReplicationInstance{
+		AppName: request.PathParameter("app-name"),
+		Id:      instanceId,
+		Action:  entity.ReplicationHeartbeat,
+	})
+	response.WriteHeader(http.StatusOK)
+}
+
+// StartEvictor 定时剔除租约过期的自定义实例
+func (es *EurekaServerServiceImpl) StartEvictor(stopCh <-chan struct{}) {
+	interval := time.Duration(embed.Env.Eureka.Eviction.IntervalInSecs) * time.Second
+	glog.Infof("Started custom instance evictor, interval: %s", interval)
+	wait.Until(es.evict, interval, stopCh)
+	glog.Info("Shutting down custom instance evictor")
+}
+
+func (es *EurekaServerServiceImpl) evict() {
+	preservationMode, renewsLastMin, threshold := selfPreservation(es.appRepo)
+	metrics.RenewsLastMin.Set(float64(renewsLastMin))
+	metrics.RenewsThreshold.Set(float64(threshold))
+	if preservationMode {
+		metrics.SelfPreservationMode.Set(1)
+		glog.Warningf("Self preservation mode is on, renews last min %d is lower than threshold %d, skip eviction",
+			renewsLastMin, threshold)
+		return
+	}
+	metrics.SelfPreservationMode.Set(0)
+	// 每个副本各自剔除内存中的实例，cm 只由 leader 修改
+	leader := k8s.IsLeader()
+	for _, instance := range es.appRepo.GetExpiredInstances(time.Now()) {
+		glog.Infof("Evict instance %s, lease expired", instance.InstanceId)
+		es.appRepo.RemoveCustomInstance(instance.InstanceId)
+		if leader {
+			k8s.DeleteInstanceFromConfigMap(instance.InstanceId)
+		}
+	}
+	if leader {
+		k8s.PruneRegisterConfigMap()
+	}
+}
+
+// selfPreservation 返回是否处于自我保护模式，以及上一分钟的心跳次数和期望的最少心跳次数。
+// 网络分区时大量实例同时停止心跳，此时暂停剔除以避免注册表被清空
+func selfPreservation(appRepo *repository.ApplicationRepository) (bool, int, int) {
+	preservation := embed.Env.Eureka.Preservation
+	renewsLastMin := appRepo.RenewsLastMin()
+	threshold := int(float64(appRepo.CountLeaseInstances()) *
+		(60.0 / float64(preservation.ExpectedRenewalIntervalInSecs)) * preservation.RenewalPercentThreshold)
+	return preservation.Enabled && threshold > 0 && renewsLastMin <= threshold, renewsLastMin, threshold
 }
 
 func (es *EurekaServerServiceImpl) Register(request *restful.Request, response *restful.Response) {
@@ -80,7 +211,7 @@ func (es *EurekaServerServiceImpl) Register(request *restful.Request, response *
 	instance := new(entity.Instance)
 	err := request.ReadEntity(instance)
 	if err != nil {
-		glog.Warningf("Register app failed when readEntity", err)
+		glog.Warningf("Register app failed when readEntity: %v", err)
 		_ = response.WriteErrorString(http.StatusBadRequest, "invalid entity Instance")
 		return
 	}
@@ -94,7 +225,7 @@ func (es *EurekaServerServiceImpl) Register(request *restful.Request, response *
 	instance.App = appName
 
 	// 生成并设置 instance id
-	instance.InstanceId = fmt.Sprintf("%s:%s:%d", instance.IPAddr, instance.App, instance.Port.Port)
+	instance.InstanceId = utils.IpInstanceId(instance.IPAddr, instance.App, instance.Port.Port)
 
 	// 保存 instance
 	if err := es.StoreCustomApp(instance); err != nil {
@@ -103,76 +234,73 @@ func (es *EurekaServerServiceImpl) Register(request *restful.Request, response *
 		return
 	}
 
+	if stored := es.appRepo.GetStoredInstance(instance.InstanceId); stored != nil {
+		es.replicateInstance(request, stored)
+	}
+
 	// 设置响应码
 	response.WriteHeader(http.StatusNoContent)
 	glog.Info("Receive registry from ", request.PathParameter("app-name"))
 }
 
 func (es *EurekaServerServiceImpl) StoreCustomApp(instance *entity.Instance) error {
+	stored, err := es.storeInstance(instance)
+	if err != nil {
+		return err
+	}
+	return es.StorageCustomAppToConfigMap(stored)
+}
+
+// storeInstance 将实例保存至内存并返回实际保存的实例，pod 生成的实例保存的是合并后的副本
+func (es *EurekaServerServiceImpl) storeInstance(instance *entity.Instance) (*entity.Instance, error) {
 	utils.ImpInstance(instance)
+	// 重新注册时保留已设置的覆盖状态
+	if value, ok := es.appRepo.CustomInstanceStore.Load(instance.InstanceId); ok {
+		if overriddenStatus := value.(*entity.Instance).OverriddenStatus; isOverridden(overriddenStatus) {
+			instance.OverriddenStatus = overriddenStatus
+			instance.Status = overriddenStatus
+		}
+	}
 	// 若为 pod 生成的实例
 	if value, ok := es.appRepo.InstanceStore.Load(instance.InstanceId); ok {
 		podInstance := value.(*entity.Instance)
 		clone, err := utils.DeepCopyInstance(podInstance)
 		if err != nil {
-			return err
-		}
-		for k, v := range instance.Metadata {
-			switch k {
-			case "provisioner", "pod-self-link", "version", "context-path":
-				continue
-			}
-			if len(v) == 0 {
-				delete(clone.Metadata, k)
-				continue
-			}
-			clone.Metadata[k] = v
+			return nil, err
 		}
+		mergeMetadata(clone, instance.Metadata)
 		clone.Status = instance.Status
-		es.appRepo.CustomInstanceStore.Store(clone.InstanceId, clone)
-		return es.StorageCustomAppToConfigMap(clone)
+		clone.OverriddenStatus = instance.OverriddenStatus
+		es.appRepo.SaveCustomInstance(clone)
+		return clone, nil
 	}
 
 	if value, ok := es.appRepo.CustomInstanceStore.Load(instance.InstanceId); ok {
 		customInstance := value.(*entity.Instance)
 		instance.LeaseInfo.RegistrationTimestamp = customInstance.LeaseInfo.RegistrationTimestamp
-		es.appRepo.CustomInstanceStore.Store(instance.InstanceId, instance)
-		return es.StorageCustomAppToConfigMap(instance)
+		es.appRepo.SaveCustomInstance(instance)
+		return instance, nil
 	}
 
 	es.appRepo.NamespaceStore.Store(
 		fmt.Sprintf("%s/%s", entity.CUSTOM_APP_PREFIX, instance.InstanceId),
 		instance.InstanceId,
 	)
-	es.appRepo.CustomInstanceStore.Store(instance.InstanceId, instance)
-	return es.StorageCustomAppToConfigMap(instance)
+	es.appRepo.SaveCustomInstance(instance)
+	return instance, nil
 }
 
 func (es *EurekaServerServiceImpl) StorageCustomAppToConfigMap(instance *entity.Instance) error {
-	// 获取cm
-	registerConfigMapClient := k8s.KubeClient.CoreV1().ConfigMaps(embed.Env.RegisterServerNamespace)
-	configMap, err := registerConfigMapClient.Get(entity.RegisterServerName, metav1.GetOptions{})
-	if err != nil {
-		return err
-	}
-	// 提取数据
-	instances := configMap.Data
-	if instances == nil {
-		instances = make(map[string]string, 1)
-	}
 	// instance转换为json
 	bytes, err := json.Marshal(instance)
 	if err != nil {
 		return err
 	}
 	// 保存instance至cm
-	instances[strings.ReplaceAll(instance.InstanceId, ":", "-")] = string(bytes)
-	configMap.Data = instances
-	_, err = registerConfigMapClient.Update(configMap)
-	if err != nil {
-		return err
-	}
-	return nil
+	return k8s.UpdateRegisterConfigMap(func(data map[string]string) bool {
+		data[utils.ConfigMapInstanceKey(instance.InstanceId)] = string(bytes)
+		return true
+	})
 }
 
 func (es *EurekaServerServiceImpl) Delete(request *restful.Request, response *restful.Response) {
@@ -181,23 +309,259 @@ func (es *EurekaServerServiceImpl) Delete(request *restful.Request, response *re
 	// 获取instance Id
 	instanceId := request.PathParameter("instance-id")
 	// 从cm中删除instance
-	registerConfigMapClient := k8s.KubeClient.CoreV1().ConfigMaps(embed.Env.RegisterServerNamespace)
-	configMap, err := registerConfigMapClient.Get(entity.RegisterServerName, metav1.GetOptions{})
+	err := k8s.UpdateRegisterConfigMap(func(data map[string]string) bool {
+		delete(data, utils.ConfigMapInstanceKey(instanceId))
+		return true
+	})
 	if err != nil {
 		_ = response.WriteErrorString(http.StatusInternalServerError,
 			fmt.Sprintf("Delete Instance Error: %s", err.Error()))
 		return
 	}
-	delete(configMap.Data, strings.ReplaceAll(instanceId, ":", "-"))
-	// 更新cm
-	_, err = registerConfigMapClient.Update(configMap)
+	// 从内存中删除instance
+	es.appRepo.DeleteInstance(fmt.Sprintf("%s/%s", entity.CUSTOM_APP_PREFIX, instanceId))
+	es.replicate(request, &entity.ReplicationInstance{
+		AppName: request.PathParameter("app-name"),
+		Id:      instanceId,
+		Action:  entity.ReplicationCancel,
+	})
+}
+
+// StatusUpdate 设置实例的覆盖状态，如 OUT_OF_SERVICE，使实例在不停止 pod 的情况下摘除流量
+func (es *EurekaServerServiceImpl) StatusUpdate(request *restful.Request, response *restful.Response) {
+	metrics.RequestCount.With(prometheus.Labels{"path": request.Request.RequestURI}).Inc()
+
+	instanceId := request.PathParameter("instance-id")
+	status := request.QueryParameter("value")
+	if !entity.IsValidStatus(status) {
+		_ = response.WriteErrorString(http.StatusBadRequest, fmt.Sprintf("invalid status: %s", status))
+		return
+	}
+	if es.writeStatusOverrideResult(response, instanceId, status, status) {
+		es.replicate(request, &entity.ReplicationInstance{
+			AppName: request.PathParameter("app-name"),
+			Id:      instanceId,
+			Status:  status,
+			Action:  entity.ReplicationStatusUpdate,
+		})
+	}
+}
+
+// DeleteStatusOverride 移除实例的覆盖状态，心跳注册的实例状态恢复为 value 参数指定的状态，默认为 UP，
+// pod 生成的实例恢复为 pod 的状态
+func (es *EurekaServerServiceImpl) DeleteStatusOverride(request *restful.Request, response *restful.Response) {
+	metrics.RequestCount.With(prometheus.Labels{"path": request.Request.RequestURI}).Inc()
+
+	instanceId := request.PathParameter("instance-id")
+	status := request.QueryParameter("value")
+	if len(status) == 0 {
+		status = entity.UP
+	} else if !entity.IsValidStatus(status) {
+		_ = response.WriteErrorString(http.StatusBadRequest, fmt.Sprintf("invalid status: %s", status))
+		return
+	}
+	if es.writeStatusOverrideResult(response, instanceId, entity.UNKNOWN, status) {
+		es.replicate(request, &entity.ReplicationInstance{
+			AppName: request.PathParameter("app-name"),
+			Id:      instanceId,
+			Status:  status,
+			Action:  entity.ReplicationDeleteStatusOverride,
+		})
+	}
+}
+
+// writeStatusOverrideResult 修改覆盖状态并写出响应，修改成功时返回 true
+func (es *EurekaServerServiceImpl) writeStatusOverrideResult(response *restful.Response,
+	instanceId string, overriddenStatus string, status string) bool {
+	found, err := es.OverrideStatus(instanceId, overriddenStatus, status)
 	if err != nil {
+		glog.Warningf("Override status of instance %s failed: %v", instanceId, err)
 		_ = response.WriteErrorString(http.StatusInternalServerError,
-			fmt.Sprintf("Delete Instance Error: %s", err.Error()))
+			fmt.Sprintf("Override Status Error: %s", err.Error()))
+		return false
+	}
+	if !found {
+		_ = response.WriteErrorString(http.StatusNotFound, fmt.Sprintf("instance %s not found", instanceId))
+		return false
+	}
+	glog.Infof("Instance %s status changed to %s, overridden status: %s", instanceId, status, overriddenStatus)
+	response.WriteHeader(http.StatusOK)
+	return true
+}
+
+// OverrideStatus 修改实例的覆盖状态并保存至 cm，pod 生成的实例会保存一份副本，
+// 因此覆盖状态不会被 pod 的更新事件覆盖；移除覆盖状态时副本只剩覆盖状态则同时删除副本与 cm 中的记录。返回 false 表示实例不存在
+func (es *EurekaServerServiceImpl) OverrideStatus(instanceId string, overriddenStatus string, status string) (bool, error) {
+	clone, removed, err := es.applyStatusOverride(instanceId, overriddenStatus, status)
+	if err != nil {
+		return true, err
+	}
+	if clone == nil {
+		return false, nil
+	}
+	if removed {
+		k8s.DeleteInstanceFromConfigMap(instanceId)
+		return true, nil
+	}
+	return true, es.StorageCustomAppToConfigMap(clone)
+}
+
+// applyStatusOverride 只在内存中修改实例的覆盖状态，实例不存在时返回 nil。
+// 移除 pod 生成的实例的覆盖状态时使 pod 的状态重新生效，副本中没有自定义的元数据时删除副本，此时返回的 removed 为 true
+func (es *EurekaServerServiceImpl) applyStatusOverride(instanceId string, overriddenStatus string,
+	status string) (*entity.Instance, bool, error) {
+	if overriddenStatus == entity.UNKNOWN {
+		if instance, removed := es.appRepo.ClearStatusOverride(instanceId); instance != nil {
+			return instance, removed, nil
+		}
+	}
+	value, ok := es.appRepo.CustomInstanceStore.Load(instanceId)
+	if !ok {
+		if value, ok = es.appRepo.InstanceStore.Load(instanceId); !ok {
+			return nil, false, nil
+		}
+	}
+	clone, err := utils.DeepCopyInstance(value.(*entity.Instance))
+	if err != nil {
+		return nil, false, err
+	}
+	clone.OverriddenStatus = overriddenStatus
+	clone.Status = status
+	es.appRepo.SaveCustomInstance(clone)
+	return clone, false, nil
+}
+
+// PeerReplicationBatch 处理其它副本批量复制过来的操作，只修改内存，
+// cm 已由接收客户端请求的副本写入，也不会再次复制给其它副本
+func (es *EurekaServerServiceImpl) PeerReplicationBatch(request *restful.Request, response *restful.Response) {
+	metrics.RequestCount.With(prometheus.Labels{"path": request.Request.RequestURI}).Inc()
+
+	replicationList := new(entity.ReplicationList)
+	if err := request.ReadEntity(replicationList); err != nil {
+		glog.Warningf("Read replication batch failed: %v", err)
+		_ = response.WriteErrorString(http.StatusBadRequest, "invalid entity ReplicationList")
 		return
 	}
-	// 从内存中删除instance
-	es.appRepo.DeleteInstance(fmt.Sprintf("%s/%s", entity.CUSTOM_APP_PREFIX, instanceId))
+	result := &entity.ReplicationListResponse{
+		ResponseList: make([]*entity.ReplicationInstanceResponse, 0, len(replicationList.ReplicationList)),
+	}
+	for _, item := range replicationList.ReplicationList {
+		result.ResponseList = append(result.ResponseList, es.dispatchReplication(item))
+	}
+	_ = response.WriteAsJson(result)
+}
+
+func (es *EurekaServerServiceImpl) dispatchReplication(item *entity.ReplicationInstance) *entity.ReplicationInstanceResponse {
+	var err error
+	statusCode := http.StatusOK
+	switch item.Action {
+	case entity.ReplicationRegister:
+		if item.InstanceInfo == nil {
+			statusCode = http.StatusBadRequest
+			break
+		}
+		_, err = es.storeInstance(item.InstanceInfo)
+	case entity.ReplicationHeartbeat:
+		if !es.appRepo.Renew(item.Id) {
+			statusCode = http.StatusNotFound
+		}
+	case entity.ReplicationCancel:
+		es.appRepo.DeleteInstance(fmt.Sprintf("%s/%s", entity.CUSTOM_APP_PREFIX, item.Id))
+	case entity.ReplicationStatusUpdate, entity.ReplicationDeleteStatusOverride:
+		overriddenStatus := item.Status
+		if item.Action == entity.ReplicationDeleteStatusOverride {
+			overriddenStatus = entity.UNKNOWN
+		}
+		var clone *entity.Instance
+		if clone, _, err = es.applyStatusOverride(item.Id, overriddenStatus, item.Status); clone == nil && err == nil {
+			statusCode = http.StatusNotFound
+		}
+	default:
+		statusCode = http.StatusBadRequest
+	}
+	if err != nil {
+		glog.Warningf("Apply replicated %s of instance %s failed: %v", item.Action, item.Id, err)
+		statusCode = http.StatusInternalServerError
+	}
+	return &entity.ReplicationInstanceResponse{StatusCode: statusCode}
+}
+
+// replicate 将客户端的操作复制给其它副本，来自其它副本的请求不再复制
+func (es *EurekaServerServiceImpl) replicate(request *restful.Request, task *entity.ReplicationInstance) {
+	if request.HeaderParameter(entity.ReplicationHeader) == "true" {
+		return
+	}
+	es.peerNodes.Replicate(task)
+}
+
+func (es *EurekaServerServiceImpl) replicateInstance(request *restful.Request, instance *entity.Instance) {
+	if request.HeaderParameter(entity.ReplicationHeader) == "true" {
+		return
+	}
+	es.peerNodes.ReplicateInstance(instance)
+}
+
+// zoneQuery 读取 zone 与 preferZone 查询参数，两者都未指定时返回 false
+func zoneQuery(request *restful.Request) (string, string, bool) {
+	zone, preferZone := request.QueryParameter("zone"), request.QueryParameter("preferZone")
+	return zone, preferZone, len(zone) > 0 || len(preferZone) > 0
+}
+
+// writeEurekaEntity 根据 Accept 请求头返回 json 或 xml，xml 与 eureka 一致，不包含 json 的外层包装
+func writeEurekaEntity(request *restful.Request, response *restful.Response, jsonEntity interface{}, xmlEntity interface{}) {
+	if acceptXml(request.HeaderParameter("Accept")) {
+		_ = response.WriteAsXml(xmlEntity)
+		return
+	}
+	_ = response.WriteAsJson(jsonEntity)
+}
+
+// writeSnapshot 直接写出快照中预先序列化的内容，ETag 未变化时返回 304，客户端支持时返回 gzip 压缩的内容
+func writeSnapshot(request *restful.Request, response *restful.Response, snapshot *repository.Snapshot) {
+	body, gzipBody, eTag, contentType := snapshot.Json, snapshot.JsonGzip, snapshot.JsonETag, restful.MIME_JSON
+	if acceptXml(request.HeaderParameter("Accept")) {
+		body, gzipBody, eTag, contentType = snapshot.Xml, snapshot.XmlGzip, snapshot.XmlETag, restful.MIME_XML
+	}
+
+	header := response.Header()
+	header.Set("ETag", eTag)
+	header.Set("Vary", "Accept, Accept-Encoding")
+	if matchETag(request.HeaderParameter("If-None-Match"), eTag) {
+		response.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	header.Set("Content-Type", contentType)
+	if gzipBody != nil && strings.Contains(request.HeaderParameter("Accept-Encoding"), "gzip") {
+		header.Set("Content-Encoding", "gzip")
+		body = gzipBody
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	response.WriteHeader(http.StatusOK)
+	_, _ = response.Write(body)
+}
+
+// matchETag 判断 If-None-Match 中是否包含指定的 ETag，按弱比较处理
+func matchETag(ifNoneMatch string, eTag string) bool {
+	if len(ifNoneMatch) == 0 {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(eTag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptXml 判断客户端是否要求 xml 格式，同时接受 json 时优先返回 json
+func acceptXml(accept string) bool {
+	return strings.Contains(accept, restful.MIME_XML) && !strings.Contains(accept, restful.MIME_JSON)
+}
+
+func isOverridden(overriddenStatus string) bool {
+	return len(overriddenStatus) > 0 && overriddenStatus != entity.UNKNOWN
 }
 
 func (es *EurekaServerServiceImpl) InitCustomAppFromConfigMap() {
@@ -205,8 +569,7 @@ func (es *EurekaServerServiceImpl) InitCustomAppFromConfigMap() {
 	registerConfigMapClient := k8s.KubeClient.CoreV1().ConfigMaps(embed.Env.RegisterServerNamespace)
 	configMap, err := registerConfigMapClient.Get(entity.RegisterServerName, metav1.GetOptions{})
 	if err == nil {
-		removeList := make([]string, 3)
-		// 取出自定义列表数据
+		// 取出自定义列表数据，只加载至内存，pod 已不存在的实例由 leader 从 cm 中清理
 		for key, value := range configMap.Data {
 			instance := new(entity.Instance)
 			err := json.Unmarshal([]byte(value), instance)
@@ -215,28 +578,20 @@ func (es *EurekaServerServiceImpl) InitCustomAppFromConfigMap() {
 				return
 			}
 			// 判断当前环境中是否存在该pod实例
-			// 不存在则标记为删除
+			// 不存在则跳过
 			if podSelfLink, ok := instance.Metadata["pod-self-link"]; ok {
 				namespace, name, err := cache.SplitMetaNamespaceKey(podSelfLink)
 				if err != nil {
-					removeList = append(removeList, key)
-					break
-				} else {
-					_, err = k8s.KubeClient.CoreV1().Pods(namespace).Get(name, metav1.GetOptions{})
-					if errors.IsNotFound(err) {
-						removeList = append(removeList, key)
-						break
-					}
+					continue
+				}
+				_, err = k8s.KubeClient.CoreV1().Pods(namespace).Get(name, metav1.GetOptions{})
+				if errors.IsNotFound(err) {
+					continue
 				}
 			}
-			es.StoreCustomApp(instance)
-		}
-
-		if len(removeList) > 0 {
-			for _, k := range removeList {
-				delete(configMap.Data, k)
+			if _, err := es.storeInstance(instance); err != nil {
+				glog.Warningf("Load instance %s from register server config map error: %v", key, err)
 			}
-			registerConfigMapClient.Update(configMap)
 		}
 	} else {
 		// 若没有相应cm，则创建
@@ -247,8 +602,9 @@ func (es *EurekaServerServiceImpl) InitCustomAppFromConfigMap() {
 					Name:      entity.RegisterServerName,
 				},
 			}
+			// 多个副本同时启动时可能已由其它副本创建
 			_, err := registerConfigMapClient.Create(cm)
-			if err != nil {
+			if err != nil && !errors.IsAlreadyExists(err) {
 				glog.Infof("create register server config map error: %+v", err)
 			}
 		} else {
@@ -264,82 +620,107 @@ func (es *EurekaServerServiceImpl) UpdateMateData(request *restful.Request, resp
 	mateDatas := make(map[string]map[string]string, 3)
 	err := request.ReadEntity(&mateDatas)
 	if err != nil {
-		glog.Warningf("invalid entity instance matedata", err)
+		glog.Warningf("invalid entity instance matedata: %v", err)
 		_ = response.WriteErrorString(http.StatusBadRequest, "invalid entity instance matedata")
 		return
 	}
 
-	// 获取自定义app列表cm
-	registerConfigMapClient := k8s.KubeClient.CoreV1().ConfigMaps(embed.Env.RegisterServerNamespace)
-	configMap, err := registerConfigMapClient.Get(entity.RegisterServerName, metav1.GetOptions{})
+	// 校验 instance 是否存在并合并元数据
+	clones := make([]*entity.Instance, 0, len(mateDatas))
+	for instanceId, instanceMateData := range mateDatas {
+		instance := es.appRepo.GetStoredInstance(instanceId)
+		if instance == nil {
+			_ = response.WriteErrorString(http.StatusNotFound, fmt.Sprintf("instance %s not found", instanceId))
+			return
+		}
+		clone, err := utils.DeepCopyInstance(instance)
+		if err != nil {
+			glog.Warningf("Deep copy instance err %s", err.Error())
+			_ = response.WriteErrorString(http.StatusBadRequest, fmt.Sprintf("Deep copy instance err: %s", err.Error()))
+			return
+		}
+		mergeMetadata(clone, instanceMateData)
+		clones = append(clones, clone)
+	}
+
+	instancesJson := make(map[string]string, len(clones))
+	for _, clone := range clones {
+		es.appRepo.SaveCustomInstance(clone)
+		// instance转换为json
+		bytes, err := json.Marshal(clone)
+		if err != nil {
+			glog.Warningf("Instance to json err %s", err.Error())
+			_ = response.WriteErrorString(http.StatusBadRequest,
+				fmt.Sprintf("Instance to json err: %s", err.Error()))
+			return
+		}
+		instancesJson[utils.ConfigMapInstanceKey(clone.InstanceId)] = string(bytes)
+	}
+	// 保存至自定义app列表cm
+	err = k8s.UpdateRegisterConfigMap(func(data map[string]string) bool {
+		for key, value := range instancesJson {
+			data[key] = value
+		}
+		return true
+	})
 	if err != nil {
-		glog.Warningf("Get configmap err %s", err.Error())
-		_ = response.WriteErrorString(http.StatusBadRequest, fmt.Sprintf("Get configmap err: %s", err.Error()))
+		glog.Warningf("Update configmap err %s", err.Error())
+		_ = response.WriteErrorString(http.StatusInternalServerError, fmt.Sprintf("Update configmap err: %s", err.Error()))
 		return
 	}
+	for _, clone := range clones {
+		es.replicateInstance(request, clone)
+	}
+}
 
-	for instanceId, instanceMateData := range mateDatas {
-		if i, ok := es.appRepo.CustomInstanceStore.Load(instanceId); ok {
-			instance := i.(*entity.Instance)
-			clone, err := utils.DeepCopyInstance(instance)
-			if err != nil {
-				glog.Warningf("Get configmap err %s", err.Error())
-				_ = response.WriteErrorString(http.StatusBadRequest, fmt.Sprintf("Deep copy instance err: %s", err.Error()))
-				return
-			}
-			for key, value := range instanceMateData {
-				switch key {
-				case "provisioner", "pod-self-link", "version", "context-path":
-					continue
-				}
-				if len(value) == 0 {
-					delete(clone.Metadata, key)
-				} else {
-					clone.Metadata[key] = value
-				}
-			}
+// UpdateInstanceMetadata 以 eureka 标准接口 PUT /eureka/apps/{app}/{id}/metadata?key=value 更新实例元数据
+func (es *EurekaServerServiceImpl) UpdateInstanceMetadata(request *restful.Request, response *restful.Response) {
+	metrics.RequestCount.With(prometheus.Labels{"path": request.Request.RequestURI}).Inc()
 
-			// instance转换为json
-			bytes, err := json.Marshal(clone)
-			if err != nil {
-				glog.Warningf("Instance to json err %s", err.Error())
-				_ = response.WriteErrorString(http.StatusBadRequest,
-					fmt.Sprintf("Instance to json err: %s", err.Error()))
-				return
-			}
-			configMap.Data[strings.ReplaceAll(instanceId, ":", "-")] = string(bytes)
+	appName := request.PathParameter("app-name")
+	instanceId := request.PathParameter("instance-id")
+	instance := es.appRepo.GetStoredInstance(instanceId)
+	if instance == nil || !strings.EqualFold(instance.App, appName) {
+		_ = response.WriteErrorString(http.StatusNotFound, fmt.Sprintf("instance %s not found", instanceId))
+		return
+	}
+
+	metadata := make(map[string]string)
+	for key, values := range request.Request.URL.Query() {
+		if len(values) > 0 {
+			metadata[key] = values[0]
+		}
+	}
+	clone, err := utils.DeepCopyInstance(instance)
+	if err != nil {
+		_ = response.WriteErrorString(http.StatusInternalServerError, fmt.Sprintf("Deep copy instance err: %s", err.Error()))
+		return
+	}
+	mergeMetadata(clone, metadata)
+	es.appRepo.SaveCustomInstance(clone)
+	if err := es.StorageCustomAppToConfigMap(clone); err != nil {
+		glog.Warningf("Update metadata of instance %s failed: %v", instanceId, err)
+		_ = response.WriteErrorString(http.StatusInternalServerError,
+			fmt.Sprintf("Update Metadata Error: %s", err.Error()))
+		return
+	}
+	es.replicateInstance(request, clone)
+	response.WriteHeader(http.StatusOK)
+}
+
+// mergeMetadata 将元数据合并至实例，保留键不允许修改，值为空时删除该键
+func mergeMetadata(instance *entity.Instance, metadata map[string]string) {
+	if instance.Metadata == nil {
+		instance.Metadata = make(map[string]string, len(metadata))
+	}
+	for key, value := range metadata {
+		if utils.ReservedMetadataKeys[key] {
+			continue
+		}
+		if len(value) == 0 {
+			delete(instance.Metadata, key)
 		} else {
-			if i, ok := es.appRepo.InstanceStore.Load(instanceId); ok {
-				instance := i.(*entity.Instance)
-				clone, err := utils.DeepCopyInstance(instance)
-				if err != nil {
-					glog.Warningf("Get configmap err %s", err.Error())
-					_ = response.WriteErrorString(http.StatusBadRequest, fmt.Sprintf("Deep copy instance err: %s", err.Error()))
-					return
-				}
-				for key, value := range instanceMateData {
-					switch key {
-					case "provisioner", "pod-self-link", "version", "context-path":
-						continue
-					}
-					if len(value) == 0 {
-						delete(clone.Metadata, key)
-					} else {
-						clone.Metadata[key] = value
-					}
-				}
-				// instance转换为json
-				bytes, err := json.Marshal(clone)
-				if err != nil {
-					glog.Warningf("Instance to json err %s", err.Error())
-					_ = response.WriteErrorString(http.StatusBadRequest,
-						fmt.Sprintf("Instance to json err: %s", err.Error()))
-					return
-				}
-				es.appRepo.CustomInstanceStore.Store(instanceId, clone)
-				configMap.Data[strings.ReplaceAll(instanceId, ":", "-")] = string(bytes)
-			}
+			instance.Metadata[key] = value
 		}
 	}
-	registerConfigMapClient.Update(configMap)
 }
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+	"github.com/choerodon/go-register-server/pkg/api/metrics"
+	"github.com/choerodon/go-register-server/pkg/api/repository"
+	"github.com/choerodon/go-register-server/pkg/embed"
+	"github.com/choerodon/go-register-server/pkg/utils"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// 健康检查响应体的最大读取长度
+const maxHealthBodySize = 64 * 1024
+
+// HealthChecker 定时请求实例的 healthCheckUrl，将 actuator 返回的状态叠加至实例状态
+type HealthChecker struct {
+	appRepo *repository.ApplicationRepository
+	client  *http.Client
+}
+
+func NewHealthChecker(appRepo *repository.ApplicationRepository) *HealthChecker {
+	client, err := utils.NewInstanceClient(time.Duration(embed.Env.Eureka.Health.TimeoutInSecs)*time.Second,
+		embed.Env.Eureka.Tls.CaFile, embed.Env.Eureka.Tls.ServerName)
+	if err != nil {
+		glog.Errorf("Load CA bundle for health check error: %v", err)
+	}
+	return &HealthChecker{
+		appRepo: appRepo,
+		client:  client,
+	}
+}
+
+func (hc *HealthChecker) Start(stopCh <-chan struct{}) {
+	config := embed.Env.Eureka.Health
+	if !config.Enabled {
+		glog.Info("Instance health check is disabled")
+		return
+	}
+	interval := time.Duration(config.IntervalInSecs) * time.Second
+	glog.Infof("Started instance health check, interval: %s", interval)
+	wait.Until(hc.checkAll, interval, stopCh)
+	glog.Info("Shutting down instance health check")
+}
+
+func (hc *HealthChecker) checkAll() {
+	config := embed.Env.Eureka.Health
+	instances := hc.appRepo.GetHealthCheckInstances()
+	instanceIds := make(map[string]bool, len(instances))
+	// 限制同时进行的请求数，配置为 0 或负数时逐个检查
+	concurrency := config.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, instance := range instances {
+		instanceIds[instance.InstanceId] = true
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(instance *entity.Instance) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			status := hc.check(instance)
+			metrics.HealthCheckCount.With(prometheus.Labels{"status": status}).Inc()
+			if hc.appRepo.ReportHealth(instance.InstanceId, status, config.FailureThreshold, config.SuccessThreshold) {
+				glog.Infof("Instance %s health status changed to %s", instance.InstanceId, status)
+			}
+		}(instance)
+	}
+	wg.Wait()
+	hc.appRepo.RetainHealth(instanceIds)
+	metrics.UnhealthyInstances.Set(float64(hc.appRepo.CountUnhealthyInstances()))
+}
+
+// check 请求实例的健康检查地址，请求失败视为 DOWN
+func (hc *HealthChecker) check(instance *entity.Instance) string {
+	res, err := hc.client.Get(instance.HealthCheckUrl)
+	if err != nil {
+		glog.V(1).Infof("Health check of instance %s failed: %v", instance.InstanceId, err)
+		return entity.DOWN
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxHealthBodySize))
+	if err != nil {
+		glog.V(1).Infof("Read health check response of instance %s failed: %v", instance.InstanceId, err)
+		return entity.DOWN
+	}
+	return utils.ConvertActuatorHealth(res.StatusCode, body)
+}
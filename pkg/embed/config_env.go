@@ -22,10 +22,15 @@ func init() {
 }
 
 type Config struct {
-	RegisterServiceNamespace []string     `profile:"register.service.namespace"`
-	RegisterServerNamespace  string       `profile:"register.server.namespace"`
-	ConfigServer             ConfigServer `profile:"config.server"`
-	Kubeconfig               string       `profile:"kubeconfig" profileDefault:""`
+	RegisterServiceNamespace []string `profile:"register.service.namespace"`
+	// 同时监听标签匹配该选择器的 namespace，为空时只监听 RegisterServiceNamespace
+	RegisterServiceNamespaceSelector string         `profile:"register.service.namespaceSelector" profileDefault:""`
+	RegisterServerNamespace          string         `profile:"register.server.namespace"`
+	ConfigServer                     ConfigServer   `profile:"config.server"`
+	Kubeconfig                       string         `profile:"kubeconfig" profileDefault:""`
+	Eureka                           Eureka         `profile:"eureka"`
+	LeaderElection                   LeaderElection `profile:"leaderElection"`
+	Labels                           Labels         `profile:"labels"`
 }
 
 type ConfigServer struct {
@@ -34,6 +39,118 @@ type ConfigServer struct {
 	Log          bool     `profileDefault:"false"`
 }
 
+type Eureka struct {
+	// pod 实例 id 的生成方式，ip 为 ip:服务名:端口，pod 为 pod名.namespace:服务名:端口
+	InstanceIdScheme string `profile:"instanceIdScheme" profileDefault:"ip"`
+	// 双栈 pod 注册的 ip 地址族，primary 为 pod 的主 ip，ipv4 或 ipv6 优先使用该地址族的 ip
+	IpFamilyPolicy string `profile:"ipFamilyPolicy" profileDefault:"primary"`
+	// 正在删除的 pod 对应实例的状态，DOWN 或 OUT_OF_SERVICE
+	TerminatingStatus string `profile:"terminatingStatus" profileDefault:"OUT_OF_SERVICE"`
+	Eviction          Eviction
+	Preservation      Preservation
+	Peer              Peer
+	Health            Health
+	Endpoints         Endpoints
+	Metadata          Metadata
+	Zone              Zone
+	NodeFailure       NodeFailure `profile:"nodeFailure"`
+	Tls               Tls
+}
+
+type Eviction struct {
+	// 剔除过期实例的时间间隔，单位秒
+	IntervalInSecs int `profile:"interval" profileDefault:"60"`
+}
+
+type Preservation struct {
+	Enabled bool `profileDefault:"true"`
+	// 客户端发送心跳的期望间隔，单位秒
+	ExpectedRenewalIntervalInSecs int `profile:"expectedRenewalInterval" profileDefault:"30"`
+	// 上一分钟心跳次数低于期望次数的该比例时进入自我保护模式
+	RenewalPercentThreshold float64 `profile:"renewalPercentThreshold" profileDefault:"0.85"`
+}
+
+type Peer struct {
+	// 是否在 go-register-server 的多个副本间复制注册、心跳、下线与覆盖状态
+	Enabled bool `profileDefault:"true"`
+	// 单次批量复制的最大任务数
+	BatchSize int `profile:"batchSize" profileDefault:"250"`
+	// 复制任务攒批的最长等待时间，单位毫秒
+	MaxBatchingDelayInMs int `profile:"maxBatchingDelay" profileDefault:"500"`
+}
+
+type Health struct {
+	// 是否定时请求实例的 healthCheckUrl，并将 actuator 返回的状态叠加至实例状态
+	Enabled bool `profileDefault:"false"`
+	// 健康检查的间隔，单位秒
+	IntervalInSecs int `profile:"interval" profileDefault:"30"`
+	// 单次请求的超时时间，单位秒
+	TimeoutInSecs int `profile:"timeout" profileDefault:"3"`
+	// 同时进行健康检查的最大请求数
+	Concurrency int `profileDefault:"10"`
+	// 连续失败多少次后实例变为不健康
+	FailureThreshold int `profile:"failureThreshold" profileDefault:"3"`
+	// 连续成功多少次后实例恢复为 UP
+	SuccessThreshold int `profile:"successThreshold" profileDefault:"1"`
+}
+
+type Metadata struct {
+	// 以这些前缀开头的 pod 标签与注解去掉前缀后复制到实例的元数据，如 eureka.metadata/group 复制为 group
+	Prefixes []string `profileDefault:"[\"eureka.metadata/\"]"`
+	// 原样复制到实例元数据的 pod 标签与注解，元数据的键为最后一个 / 之后的部分
+	Keys []string `profileDefault:"[]"`
+}
+
+type Zone struct {
+	// 是否读取 pod 所在节点的 topology.kubernetes.io/zone 与 region 标签，写入实例的 zone、region 元数据与 dataCenterInfo，
+	// 需要读取节点的集群权限
+	Enabled bool `profileDefault:"false"`
+}
+
+type NodeFailure struct {
+	// 是否在节点未就绪或失联超过宽限期后将其上的 pod 实例标记为下线，节点恢复后还原
+	Enabled bool `profileDefault:"false"`
+	// 节点未就绪多久后标记实例，单位秒
+	GracePeriodInSecs int `profile:"gracePeriod" profileDefault:"40"`
+	// 标记的实例状态，DOWN 或 OUT_OF_SERVICE
+	Status string `profileDefault:"DOWN"`
+}
+
+type Tls struct {
+	// PEM 格式的 CA 证书文件，健康检查与通知实例刷新配置时用于校验 https 实例的证书，为空时只信任系统 CA
+	CaFile string `profile:"caFile" profileDefault:""`
+	// 校验实例证书时使用的名称，请求发往 pod ip，为空时以 ip 校验，实例证书需包含该名称
+	ServerName string `profile:"serverName" profileDefault:""`
+}
+
+type Endpoints struct {
+	// 是否将带有 choerodon.io/register=true 注解的 Service 的 Endpoints 注册为实例
+	Enabled bool `profileDefault:"false"`
+}
+
+// Labels 是读取 pod 标签、Service 与 ConfigMap 注解时使用的键，每项按顺序取第一个存在的键，
+// 如 choerodon.io/service 不存在时使用 app.kubernetes.io/name。写入 ConfigMap 注解时使用每项的第一个键
+type Labels struct {
+	Service          []string `profileDefault:"[\"choerodon.io/service\"]"`
+	Version          []string `profileDefault:"[\"choerodon.io/version\"]"`
+	ManagementPort   []string `profile:"managementPort" profileDefault:"[\"choerodon.io/metrics-port\"]"`
+	ContextPath      []string `profile:"contextPath" profileDefault:"[\"choerodon.io/context-path\"]"`
+	Feature          []string `profileDefault:"[\"choerodon.io/feature\"]"`
+	VipAddress       []string `profile:"vipAddress" profileDefault:"[\"choerodon.io/vip-address\"]"`
+	SecureVipAddress []string `profile:"secureVipAddress" profileDefault:"[\"choerodon.io/secure-vip-address\"]"`
+}
+
+type LeaderElection struct {
+	// 多副本时是否通过 Lease 选举 leader，只有 leader 清理 cm 中的实例并通知实例刷新配置
+	Enabled bool `profileDefault:"true"`
+	// leader 未续约超过该时长后其它副本可以接管，单位秒
+	LeaseDurationInSecs int `profile:"leaseDuration" profileDefault:"15"`
+	// leader 超过该时长未能续约即退出，需小于 leaseDuration 且大于 retryPeriod，单位秒
+	RenewDeadlineInSecs int `profile:"renewDeadline" profileDefault:"10"`
+	// 竞选与续约的间隔，单位秒
+	RetryPeriodInSecs int `profile:"retryPeriod" profileDefault:"5"`
+}
+
 func (config Config) IsRegisterServiceNamespace(ns string) bool {
 	for _, n := range config.RegisterServiceNamespace {
 		if n == ns {
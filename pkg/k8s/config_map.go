@@ -11,15 +11,14 @@ import (
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	coreV1 "k8s.io/client-go/kubernetes/typed/core/v1"
-	listerV1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/client-go/util/workqueue"
 	"net/http"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
@@ -39,31 +38,37 @@ type ConfigMapOperatorImpl struct {
 	queue workqueue.RateLimitingInterface
 	// workerLoopPeriod is the time between worker runs. The workers process the queue of configMap and pod changes.
 	workerLoopPeriod time.Duration
-	lister           listerV1.ConfigMapLister
+	lister           configMapListers
 	configMapsSynced cache.InformerSynced
 	configMapCache   *sync.Map
 	kubeV1Client     coreV1.CoreV1Interface
 	notify           chan string
 	appRepo          *repository.ApplicationRepository
 	appNamespace     *sync.Map
+	// httpClient 用于通知实例刷新配置，按 eureka.tls 的配置校验 https 实例的证书
+	httpClient *http.Client
 }
 
 func NewConfigMapOperator() ConfigMapOperator {
 	if ConfigMapClient != nil {
 		return ConfigMapClient
 	}
-	configMapInformer := KubeInformerFactory.Core().V1().ConfigMaps()
 	ConfigMapClient = &ConfigMapOperatorImpl{
 		queue:            workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "cofigmap"),
 		workerLoopPeriod: time.Second,
-		lister:           configMapInformer.Lister(),
+		lister:           Informers,
 		notify:           make(chan string, 50),
 		appRepo:          AppRepo,
 		appNamespace:     &sync.Map{},
 		kubeV1Client:     KubeClient.CoreV1(),
 		configMapCache:   &sync.Map{},
 	}
-	configMapInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+	httpClient, err := utils.NewInstanceClient(0, embed.Env.Eureka.Tls.CaFile, embed.Env.Eureka.Tls.ServerName)
+	if err != nil {
+		glog.Errorf("Load CA bundle for config refresh notification error: %v", err)
+	}
+	ConfigMapClient.httpClient = httpClient
+	handler := cache.ResourceEventHandlerFuncs{
 		AddFunc: ConfigMapClient.enqueueConfigMap,
 		UpdateFunc: func(old, new interface{}) {
 			newConfigMap := new.(*v1.ConfigMap)
@@ -74,8 +79,10 @@ func NewConfigMapOperator() ConfigMapOperator {
 			ConfigMapClient.enqueueConfigMap(new)
 		},
 		DeleteFunc: ConfigMapClient.enqueueConfigMap,
-	})
-	ConfigMapClient.configMapsSynced = configMapInformer.Informer().HasSynced
+	}
+	Informers.AddEventHandler(configMapResource, handler)
+	Informers.AddEventHandler(registerConfigMapResource, handler)
+	ConfigMapClient.configMapsSynced = Informers.HasSynced
 	return ConfigMapClient
 }
 
@@ -94,6 +101,10 @@ func (c *ConfigMapOperatorImpl) StartMonitor(stopCh <-chan struct{}) {
 		for {
 			if d, ok := <-c.notify; ok {
 				glog.Infof("ConfigMap %s Changes detected", d)
+				// 只由 leader 通知实例刷新配置，避免每个副本各通知一次
+				if !IsLeader() {
+					continue
+				}
 				instances := make([]*entity.Instance, 0)
 				if entity.RouteConfigMap == d {
 					for _, gateway := range embed.Env.ConfigServer.GatewayNames {
@@ -119,6 +130,17 @@ func (c *ConfigMapOperatorImpl) enqueueConfigMap(obj interface{}) {
 	c.queue.AddRateLimited(key)
 }
 
+func (c *ConfigMapOperatorImpl) enqueueNamespace(namespace string) {
+	configMaps, err := c.lister.ConfigMaps(namespace).List(labels.Everything())
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	for _, configMap := range configMaps {
+		c.enqueueConfigMap(configMap)
+	}
+}
+
 func (c *ConfigMapOperatorImpl) runWorker() {
 	for c.processNextWorkItem() {
 	}
@@ -159,7 +181,7 @@ func (c *ConfigMapOperatorImpl) syncHandler(key string) (bool, error) {
 		return true, nil
 	}
 
-	if !embed.Env.IsRegisterServiceNamespace(namespace) {
+	if !IsWatchedNamespace(namespace) {
 		return true, nil
 	}
 
@@ -173,7 +195,7 @@ func (c *ConfigMapOperatorImpl) syncHandler(key string) (bool, error) {
 		return false, err
 	}
 
-	if configMap.Annotations[entity.ChoerodonFeature] == entity.ChoerodonFeatureConfig {
+	if feature, _ := LabelKeys().LookupFeature(configMap.Annotations); feature == entity.ChoerodonFeatureConfig {
 		sha, ok := c.configMapCache.Load(configMap.Name)
 		newSha := utils.Sha256Map(configMap.Data)
 		if ok {
@@ -191,12 +213,7 @@ func (c *ConfigMapOperatorImpl) syncHandler(key string) (bool, error) {
 }
 
 func isMonitorNamespace(namespace string) bool {
-	for _, ns := range embed.Env.RegisterServiceNamespace {
-		if strings.Compare(ns, namespace) == 0 {
-			return true
-		}
-	}
-	return false
+	return IsWatchedNamespace(namespace)
 }
 
 func (c *ConfigMapOperatorImpl) notifyRefresh(instance []*entity.Instance) {
@@ -204,7 +221,10 @@ func (c *ConfigMapOperatorImpl) notifyRefresh(instance []*entity.Instance) {
 		return
 	}
 	for _, v := range instance {
-		noticeUri := "http://" + v.IPAddr + ":" + strconv.Itoa(int(v.Port.Port))
+		noticeUri := utils.BaseUrl("http", v.IPAddr, v.Port.Port)
+		if v.SecurePort.Enabled {
+			noticeUri = utils.BaseUrl("https", v.IPAddr, v.SecurePort.Port)
+		}
 		context := v.Metadata[entity.ChoerodonContextPathLabel]
 		if context != "" {
 			noticeUri = noticeUri + "/" + context
@@ -217,7 +237,7 @@ func (c *ConfigMapOperatorImpl) notifyRefresh(instance []*entity.Instance) {
 			"CJjcmVkZW50aWFsc05vbkV4cGlyZWQiOnRydWUsImVuYWJsZWQiOnRydWUsInVzZXJJZCI6MCwiZW1h"+
 			"aWwiOm51bGwsInRpbWVab25lIjoiQ1RUIiwibGFuZ3VhZ2UiOiJ6aF9DTiIsIm9yZ2FuaXphdGlvbklkI"+
 			"joxLCJhZGRpdGlvbkluZm8iOm51bGwsImFkbWluIjpmYWxzZX0.Bw96KnS4ZRyEY-77zIetuObbqcu2LR7J03MqwPS6pLI")
-		res, err := http.DefaultClient.Do(req)
+		res, err := c.httpClient.Do(req)
 		if err != nil {
 			glog.Warningf("Notify instance %s refresh config failed, error: %s", v.InstanceId, err.Error())
 		} else if 200 <= res.StatusCode && res.StatusCode < 300 {
@@ -229,13 +249,13 @@ func (c *ConfigMapOperatorImpl) notifyRefresh(instance []*entity.Instance) {
 }
 
 func (c *ConfigMapOperatorImpl) QueryConfigMapByName(name string) *v1.ConfigMap {
-	if v, ok := c.appNamespace.Load(name); ok {
+	if v, ok := c.appNamespace.Load(name); ok && IsWatchedNamespace(v.(string)) {
 		configMap, err := c.kubeV1Client.ConfigMaps(v.(string)).Get(name, metaV1.GetOptions{})
 		if err == nil {
 			return configMap
 		}
 	}
-	for _, namespace := range embed.Env.RegisterServiceNamespace {
+	for _, namespace := range WatchedNamespaceNames() {
 		configMap, err := c.kubeV1Client.ConfigMaps(namespace).Get(name, metaV1.GetOptions{})
 		if err == nil {
 			c.appNamespace.Store(name, namespace)
@@ -246,13 +266,13 @@ func (c *ConfigMapOperatorImpl) QueryConfigMapByName(name string) *v1.ConfigMap
 }
 
 func (c *ConfigMapOperatorImpl) QueryConfigMapAndNamespaceByName(name string) (*v1.ConfigMap, string) {
-	if v, ok := c.appNamespace.Load(name); ok {
+	if v, ok := c.appNamespace.Load(name); ok && IsWatchedNamespace(v.(string)) {
 		configMap, err := c.kubeV1Client.ConfigMaps(v.(string)).Get(name, metaV1.GetOptions{})
 		if err == nil {
 			return configMap, fmt.Sprintf("%v", v)
 		}
 	}
-	for _, namespace := range embed.Env.RegisterServiceNamespace {
+	for _, namespace := range WatchedNamespaceNames() {
 		configMap, err := c.kubeV1Client.ConfigMaps(namespace).Get(name, metaV1.GetOptions{})
 		if err == nil {
 			c.appNamespace.Store(name, namespace)
@@ -296,12 +316,13 @@ func (c *ConfigMapOperatorImpl) QueryConfigMap(name string, namespace string) *v
 func newV1ConfigMap(dto *entity.SaveConfigDTO) *v1.ConfigMap {
 	return &v1.ConfigMap{
 		ObjectMeta: metaV1.ObjectMeta{
-			Namespace: dto.Namespace,
-			Name:      dto.Service,
+			Namespace:       dto.Namespace,
+			Name:            dto.Service,
+			ResourceVersion: dto.ResourceVersion,
 			Annotations: map[string]string{
-				entity.ChoerodonService: dto.Service,
-				entity.ChoerodonVersion: dto.Version,
-				entity.ChoerodonFeature: entity.ChoerodonFeatureConfig,
+				LabelKeys().ServiceKey(): dto.Service,
+				LabelKeys().VersionKey(): dto.Version,
+				LabelKeys().FeatureKey(): entity.ChoerodonFeatureConfig,
 			},
 		},
 		Data: map[string]string{utils.ConfigMapProfileKey(dto.Profile): dto.Yaml},
@@ -309,16 +330,77 @@ func newV1ConfigMap(dto *entity.SaveConfigDTO) *v1.ConfigMap {
 }
 
 func DeleteInstanceFromConfigMap(key string) {
+	err := UpdateRegisterConfigMap(func(data map[string]string) bool {
+		cmKey := utils.ConfigMapInstanceKey(key)
+		if _, ok := data[cmKey]; !ok {
+			return false
+		}
+		delete(data, cmKey)
+		return true
+	})
+	if err != nil {
+		glog.Errorf("%+v", err)
+	}
+}
+
+// UpdateRegisterConfigMap 修改 go-register-server cm 中保存的实例，modify 返回 false 表示无需更新。
+// 多个副本会同时修改该 cm，更新时携带读取到的 resourceVersion，冲突时重新读取并重试，避免覆盖其它副本的修改
+func UpdateRegisterConfigMap(modify func(data map[string]string) bool) error {
 	cmClient := KubeClient.CoreV1().ConfigMaps(embed.Env.RegisterServerNamespace)
-	configMap, err := cmClient.Get(entity.RegisterServerName, metaV1.GetOptions{})
-	if err == nil {
-		delete(configMap.Data, strings.ReplaceAll(key, ":", "-"))
-		_, err := cmClient.Update(configMap)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := cmClient.Get(entity.RegisterServerName, metaV1.GetOptions{})
 		if err != nil {
-			glog.Error("%+v", err)
+			return err
+		}
+		if configMap.Data == nil {
+			configMap.Data = make(map[string]string)
+		}
+		if !modify(configMap.Data) {
+			return nil
+		}
+		_, err = cmClient.Update(configMap)
+		return err
+	})
+}
+
+// PruneRegisterConfigMap 删除 cm 中 pod 已不存在的实例，只由 leader 执行
+func PruneRegisterConfigMap() {
+	if !Informers.HasSynced() {
+		return
+	}
+	err := UpdateRegisterConfigMap(func(data map[string]string) bool {
+		pruned := false
+		for key, value := range data {
+			instance := new(entity.Instance)
+			if err := json.Unmarshal([]byte(value), instance); err != nil {
+				continue
+			}
+			podSelfLink, ok := instance.Metadata["pod-self-link"]
+			if !ok {
+				continue
+			}
+			namespace, name, err := cache.SplitMetaNamespaceKey(podSelfLink)
+			if err == nil {
+				_, err = Informers.Pods(namespace).Get(name)
+			}
+			if err != nil {
+				glog.Infof("Prune instance %s from register config map, pod %s no longer exists", key, podSelfLink)
+				delete(data, key)
+				pruned = true
+				continue
+			}
+			// pod 的 ip 或标签变化后实例 id 随之变化，旧 id 的记录不再有效
+			if instanceId, ok := AppRepo.NamespaceStore.Load(podSelfLink); ok && instanceId != instance.InstanceId {
+				glog.Infof("Prune instance %s from register config map, pod %s is registered as %s now",
+					key, podSelfLink, instanceId)
+				delete(data, key)
+				pruned = true
+			}
 		}
-	} else {
-		glog.Error("%+v", err)
+		return pruned
+	})
+	if err != nil {
+		glog.Warningf("Prune register config map failed: %v", err)
 	}
 }
 
@@ -337,14 +419,14 @@ func updateInstance(c *ConfigMapOperatorImpl) {
 	deleteList := make([]string, 0)
 	c.appRepo.CustomInstanceStore.Range(func(key, value interface{}) bool {
 		instanceId := key.(string)
-		if _, ok := configMap.Data[strings.ReplaceAll(instanceId, ":", "-")]; !ok {
+		if _, ok := configMap.Data[utils.ConfigMapInstanceKey(instanceId)]; !ok {
 			deleteList = append(deleteList, instanceId)
 		}
 		return true
 	})
 	// 从内存中删除
 	for _, d := range deleteList {
-		c.appRepo.CustomInstanceStore.Delete(d)
+		c.appRepo.RemoveCustomInstance(d)
 	}
 	// 更新instance
 	for key, value := range configMap.Data {
@@ -354,6 +436,17 @@ func updateInstance(c *ConfigMapOperatorImpl) {
 			glog.Infof("Unmarshal register server config map of instancesJson error: %+v %s", e, key)
 			return
 		}
-		c.appRepo.CustomInstanceStore.Store(instance.InstanceId, instance)
+		if value, ok := c.appRepo.CustomInstanceStore.Load(instance.InstanceId); ok {
+			existInstance := value.(*entity.Instance)
+			// 跳过未发生变化的instance，避免重复产生增量记录
+			if existInstance.LastUpdatedTimestamp == instance.LastUpdatedTimestamp {
+				continue
+			}
+			// 心跳不会写入cm，保留内存中最新的续约时间
+			if existInstance.LeaseInfo.LastRenewalTimestamp > instance.LeaseInfo.LastRenewalTimestamp {
+				instance.LeaseInfo.LastRenewalTimestamp = existInstance.LeaseInfo.LastRenewalTimestamp
+			}
+		}
+		c.appRepo.SyncCustomInstance(instance)
 	}
 }
@@ -0,0 +1,201 @@
+package k8s
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+	"github.com/choerodon/go-register-server/pkg/api/repository"
+	"github.com/choerodon/go-register-server/pkg/embed"
+	"github.com/choerodon/go-register-server/pkg/utils"
+)
+
+var EndpointsClient *EndpointsOperator
+
+// EndpointsOperator 将带有 choerodon.io/register=true 注解的 Service 的地址注册为实例，
+// 用于 pod 无法带上 choerodon.io 标签的工作负载
+type EndpointsOperator struct {
+	servicesLister  serviceListers
+	endpointsLister endpointsListers
+	synced          cache.InformerSynced
+	workQueue       workqueue.RateLimitingInterface
+	appRepo         *repository.ApplicationRepository
+	options         utils.PodConvertOptions
+
+	lock sync.Mutex
+	// registered 保存 Service 的 key 与其已注册实例在仓库中的 key
+	registered map[string]map[string]bool
+}
+
+func NewEndpointsOperator() *EndpointsOperator {
+	if EndpointsClient != nil {
+		return EndpointsClient
+	}
+	EndpointsClient = &EndpointsOperator{
+		servicesLister:  Informers,
+		endpointsLister: Informers,
+		synced:          Informers.HasSynced,
+		workQueue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Endpoints"),
+		appRepo:         AppRepo,
+		options: utils.PodConvertOptions{
+			InstanceIdScheme: embed.Env.Eureka.InstanceIdScheme,
+			LabelKeys:        LabelKeys(),
+			MetadataPrefixes: embed.Env.Eureka.Metadata.Prefixes,
+			MetadataKeys:     embed.Env.Eureka.Metadata.Keys,
+		},
+		registered: make(map[string]map[string]bool),
+	}
+
+	// Service 与其 Endpoints 的 key 相同
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: EndpointsClient.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if oldObj.(metaV1.Object).GetResourceVersion() == newObj.(metaV1.Object).GetResourceVersion() {
+				return
+			}
+			EndpointsClient.enqueue(newObj)
+		},
+		DeleteFunc: EndpointsClient.enqueue,
+	}
+	Informers.AddEventHandler(serviceResource, handler)
+	Informers.AddEventHandler(endpointsResource, handler)
+
+	return EndpointsClient
+}
+
+func (c *EndpointsOperator) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.workQueue.AddRateLimited(key)
+}
+
+func (c *EndpointsOperator) enqueueNamespace(namespace string) {
+	services, err := c.servicesLister.Services(namespace).List(labels.Everything())
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	for _, service := range services {
+		c.enqueue(service)
+	}
+}
+
+func (c *EndpointsOperator) StartMonitor(stopCh <-chan struct{}) {
+	defer runtime.HandleCrash()
+	defer c.workQueue.ShutDown()
+
+	glog.Info("Waiting for endpoints informer caches to sync")
+	if ok := cache.WaitForCacheSync(stopCh, c.synced); !ok {
+		glog.Error("failed to wait for caches to sync")
+	}
+
+	glog.Info("Starting k8s endpoints monitor")
+	for i := 0; i < 2; i++ {
+		go wait.Until(func() {
+			for c.processNextWorkItem() {
+			}
+		}, time.Second, stopCh)
+	}
+
+	<-stopCh
+	glog.Info("Shutting down k8s endpoints monitor")
+}
+
+func (c *EndpointsOperator) processNextWorkItem() bool {
+	key, shutdown := c.workQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.workQueue.Done(key)
+
+	if err := c.syncHandler(key.(string)); err != nil {
+		runtime.HandleError(fmt.Errorf("error syncing '%s': %s", key, err.Error()))
+		c.workQueue.AddRateLimited(key)
+		return true
+	}
+	c.workQueue.Forget(key)
+	return true
+}
+
+func (c *EndpointsOperator) syncHandler(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("invalid resource key: %s", key))
+		return nil
+	}
+	instances, err := c.instances(namespace, name)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]bool, len(instances))
+	for _, instance := range instances {
+		// 地址所在的 pod 已由 pod 监听注册为相同的实例时以 pod 生成的实例为准，两者不共用同一个实例
+		if value, ok := c.appRepo.InstanceStore.Load(instance.InstanceId); ok &&
+			value.(*entity.Instance).Metadata["provisioner"] == entity.PodProvisioner {
+			continue
+		}
+		instanceKey := fmt.Sprintf("endpoints/%s/%s", key, instance.InstanceId)
+		keys[instanceKey] = true
+		if c.appRepo.Register(instance, instanceKey) {
+			glog.Info(instanceKey, " ", instance.Status)
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for instanceKey := range c.registered[key] {
+		if keys[instanceKey] {
+			continue
+		}
+		if ins := c.appRepo.DeleteInstance(instanceKey); ins != nil {
+			if IsLeader() {
+				DeleteInstanceFromConfigMap(ins.InstanceId)
+			}
+			glog.Info(instanceKey, " DOWN")
+		}
+	}
+	if len(keys) == 0 {
+		delete(c.registered, key)
+	} else {
+		c.registered[key] = keys
+	}
+	return nil
+}
+
+// instances 返回 Service 的实例，Service 已删除、未开启注册或其命名空间未被监听时返回空
+func (c *EndpointsOperator) instances(namespace string, name string) ([]*entity.Instance, error) {
+	if !IsWatchedNamespace(namespace) {
+		return nil, nil
+	}
+	service, err := c.servicesLister.Services(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if service.Annotations[entity.ChoerodonRegisterAnnotation] != "true" {
+		return nil, nil
+	}
+	endpoints, err := c.endpointsLister.Endpoints(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return utils.ConvertEndpoints2Instances(service, endpoints, c.options), nil
+}
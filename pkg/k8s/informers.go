@@ -0,0 +1,276 @@
+package k8s
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	kubeInformers "k8s.io/client-go/informers"
+	coreInformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	coreListeners "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+	"github.com/choerodon/go-register-server/pkg/embed"
+)
+
+// 每个被监听的命名空间中监听的资源
+const (
+	podResource       = "pods"
+	configMapResource = "configmaps"
+	serviceResource   = "services"
+	endpointsResource = "endpoints"
+	// registerConfigMapResource 是注册中心所在命名空间中的 go-register-server ConfigMap
+	registerConfigMapResource = "register-configmap"
+)
+
+var Informers *NamespacedInformers
+
+// NamespacedInformers 只在被监听的命名空间中运行 pod、ConfigMap、Service 与 Endpoints 的 informer，
+// 内存占用与 RBAC 权限范围随被监听的命名空间而不是整个集群增长。
+// 事件处理器必须在 Start 之前添加，只为添加了处理器的资源创建 informer
+type NamespacedInformers struct {
+	client kubernetes.Interface
+	resync time.Duration
+
+	// peerPods 监听 go-register-server 的 pod，registerConfigMap 监听 go-register-server 的 ConfigMap，
+	// 无论注册中心所在命名空间是否被监听，两者都在该命名空间中运行
+	peerPods          kubeInformers.SharedInformerFactory
+	registerConfigMap kubeInformers.SharedInformerFactory
+
+	lock       sync.RWMutex
+	stopCh     <-chan struct{}
+	handlers   map[string][]cache.ResourceEventHandler
+	namespaces map[string]*namespaceInformers
+}
+
+type namespaceInformers struct {
+	// pods 与其他资源分开，以便按服务标签过滤 pod
+	pods   kubeInformers.SharedInformerFactory
+	others kubeInformers.SharedInformerFactory
+	synced []cache.InformerSynced
+	stopCh chan struct{}
+	active bool
+}
+
+func NewNamespacedInformers(client kubernetes.Interface, resync time.Duration) *NamespacedInformers {
+	if Informers != nil {
+		return Informers
+	}
+	namespace := kubeInformers.WithNamespace(embed.Env.RegisterServerNamespace)
+	Informers = &NamespacedInformers{
+		client: client,
+		resync: resync,
+		peerPods: kubeInformers.NewSharedInformerFactoryWithOptions(client, resync, namespace,
+			kubeInformers.WithTweakListOptions(peerPodListOptions)),
+		registerConfigMap: kubeInformers.NewSharedInformerFactoryWithOptions(client, resync, namespace,
+			kubeInformers.WithTweakListOptions(func(options *metaV1.ListOptions) {
+				options.FieldSelector = fields.OneTermEqualSelector("metadata.name", entity.RegisterServerName).String()
+			})),
+		handlers:   make(map[string][]cache.ResourceEventHandler),
+		namespaces: make(map[string]*namespaceInformers),
+	}
+	for _, namespace := range embed.Env.RegisterServiceNamespace {
+		Informers.Watch(namespace)
+	}
+	return Informers
+}
+
+// AddEventHandler 为每个被监听命名空间中该资源的 informer 添加事件处理器，
+// Start 之后添加的处理器会被忽略，此时对应的 operator 不会启动
+func (i *NamespacedInformers) AddEventHandler(resource string, handler cache.ResourceEventHandler) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.stopCh != nil {
+		glog.Warningf("Informers already started, ignore event handler of %s", resource)
+		return
+	}
+	if resource == registerConfigMapResource {
+		i.registerConfigMap.Core().V1().ConfigMaps().Informer().AddEventHandler(handler)
+		return
+	}
+	i.handlers[resource] = append(i.handlers[resource], handler)
+}
+
+func (i *NamespacedInformers) Start(stopCh <-chan struct{}) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.stopCh = stopCh
+	i.peerPods.Start(stopCh)
+	i.registerConfigMap.Start(stopCh)
+	for namespace, informers := range i.namespaces {
+		i.start(namespace, informers)
+	}
+}
+
+// Watch 启动命名空间的 informer，operator 会收到其中对象的新增事件
+func (i *NamespacedInformers) Watch(namespace string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if _, ok := i.namespaces[namespace]; ok {
+		return
+	}
+	informers := &namespaceInformers{stopCh: make(chan struct{})}
+	i.namespaces[namespace] = informers
+	if i.stopCh != nil {
+		i.start(namespace, informers)
+	}
+}
+
+// Unwatch 停止命名空间的 informer 并丢弃其缓存
+func (i *NamespacedInformers) Unwatch(namespace string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	informers, ok := i.namespaces[namespace]
+	if !ok {
+		return
+	}
+	delete(i.namespaces, namespace)
+	if informers.active {
+		close(informers.stopCh)
+		glog.Infof("Stopped informers of namespace %s", namespace)
+	}
+}
+
+func (i *NamespacedInformers) start(namespace string, informers *namespaceInformers) {
+	if informers.active {
+		return
+	}
+	informers.pods = kubeInformers.NewSharedInformerFactoryWithOptions(i.client, i.resync,
+		kubeInformers.WithNamespace(namespace), kubeInformers.WithTweakListOptions(podListOptions))
+	informers.others = kubeInformers.NewSharedInformerFactoryWithOptions(i.client, i.resync,
+		kubeInformers.WithNamespace(namespace))
+	for resource, handlers := range i.handlers {
+		informer := informers.informer(resource)
+		for _, handler := range handlers {
+			informer.AddEventHandler(handler)
+		}
+		informers.synced = append(informers.synced, informer.HasSynced)
+	}
+	informers.active = true
+	// 注册中心停止时一并停止命名空间的 informer
+	go func(stopCh <-chan struct{}, namespaceStopCh chan struct{}) {
+		select {
+		case <-stopCh:
+			i.Unwatch(namespace)
+		case <-namespaceStopCh:
+		}
+	}(i.stopCh, informers.stopCh)
+	informers.pods.Start(informers.stopCh)
+	informers.others.Start(informers.stopCh)
+	glog.Infof("Started informers of namespace %s", namespace)
+}
+
+// podListOptions 只在服务标签没有备选标签时按该标签过滤 pod，
+// 标签选择器无法表达备选标签链
+func podListOptions(options *metaV1.ListOptions) {
+	if keys := LabelKeys().Service; len(keys) == 1 {
+		options.LabelSelector = keys[0]
+	}
+}
+
+// peerPodListOptions 只在服务标签没有备选标签时按该标签过滤 go-register-server 的 pod，
+// 否则由 PeerUrls 按备选标签链过滤
+func peerPodListOptions(options *metaV1.ListOptions) {
+	if keys := LabelKeys().Service; len(keys) == 1 {
+		options.LabelSelector = labels.Set{keys[0]: entity.RegisterServerName}.String()
+	}
+}
+
+func (informers *namespaceInformers) informer(resource string) cache.SharedIndexInformer {
+	switch resource {
+	case podResource:
+		return informers.pods.Core().V1().Pods().Informer()
+	case configMapResource:
+		return informers.others.Core().V1().ConfigMaps().Informer()
+	case serviceResource:
+		return informers.others.Core().V1().Services().Informer()
+	default:
+		return informers.others.Core().V1().Endpoints().Informer()
+	}
+}
+
+// HasSynced 在所有被监听命名空间的 informer 都已同步时返回 true
+func (i *NamespacedInformers) HasSynced() bool {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	if i.stopCh == nil {
+		return false
+	}
+	for _, informers := range i.namespaces {
+		for _, synced := range informers.synced {
+			if !synced() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// namespace 返回命名空间中运行的 informer，命名空间未被监听时返回 nil
+func (i *NamespacedInformers) namespace(namespace string) *namespaceInformers {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	if informers, ok := i.namespaces[namespace]; ok && informers.active {
+		return informers
+	}
+	return nil
+}
+
+// emptyIndexer 用于未被监听的命名空间的 lister，查询结果总是为空
+var emptyIndexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+	cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+
+func (i *NamespacedInformers) Pods(namespace string) coreListeners.PodNamespaceLister {
+	if informers := i.namespace(namespace); informers != nil {
+		return informers.pods.Core().V1().Pods().Lister().Pods(namespace)
+	}
+	return coreListeners.NewPodLister(emptyIndexer).Pods(namespace)
+}
+
+func (i *NamespacedInformers) ConfigMaps(namespace string) coreListeners.ConfigMapNamespaceLister {
+	if informers := i.namespace(namespace); informers != nil {
+		return informers.others.Core().V1().ConfigMaps().Lister().ConfigMaps(namespace)
+	}
+	return coreListeners.NewConfigMapLister(emptyIndexer).ConfigMaps(namespace)
+}
+
+func (i *NamespacedInformers) Services(namespace string) coreListeners.ServiceNamespaceLister {
+	if informers := i.namespace(namespace); informers != nil {
+		return informers.others.Core().V1().Services().Lister().Services(namespace)
+	}
+	return coreListeners.NewServiceLister(emptyIndexer).Services(namespace)
+}
+
+func (i *NamespacedInformers) Endpoints(namespace string) coreListeners.EndpointsNamespaceLister {
+	if informers := i.namespace(namespace); informers != nil {
+		return informers.others.Core().V1().Endpoints().Lister().Endpoints(namespace)
+	}
+	return coreListeners.NewEndpointsLister(emptyIndexer).Endpoints(namespace)
+}
+
+// PeerPods 返回注册中心所在命名空间中 go-register-server pod 的 informer
+func (i *NamespacedInformers) PeerPods() coreInformers.PodInformer {
+	return i.peerPods.Core().V1().Pods()
+}
+
+// operator 使用的 lister，所有查询都限定在某个命名空间内
+type podListers interface {
+	Pods(namespace string) coreListeners.PodNamespaceLister
+}
+
+type configMapListers interface {
+	ConfigMaps(namespace string) coreListeners.ConfigMapNamespaceLister
+}
+
+type serviceListers interface {
+	Services(namespace string) coreListeners.ServiceNamespaceLister
+}
+
+type endpointsListers interface {
+	Endpoints(namespace string) coreListeners.EndpointsNamespaceLister
+}
@@ -0,0 +1,229 @@
+package k8s
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	coordinationV1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coordinationClient "k8s.io/client-go/kubernetes/typed/coordination/v1"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+	"github.com/choerodon/go-register-server/pkg/api/metrics"
+	"github.com/choerodon/go-register-server/pkg/embed"
+)
+
+var LeaderClient *LeaderElector
+
+// LeaderElector 通过名为 go-register-server 的 coordination.k8s.io Lease 选出一个副本，
+// 只有 leader 会清理注册 ConfigMap、从中删除被剔除的实例以及通知实例刷新配置
+type LeaderElector struct {
+	client        coordinationClient.LeasesGetter
+	identity      string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+
+	lock sync.Mutex
+	// observedLease 与 observedTime 记录其他副本持有的 lease，
+	// 按本地时间超过 leaseDuration 未续约则 lease 过期
+	observedLease *coordinationV1.LeaseSpec
+	observedTime  time.Time
+	leader        bool
+	lastRenewTime time.Time
+}
+
+func NewLeaderElector() *LeaderElector {
+	if LeaderClient != nil {
+		return LeaderClient
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		glog.Warningf("Get hostname of current pod failed: %v", err)
+	}
+	config := embed.Env.LeaderElection
+	LeaderClient = &LeaderElector{
+		client:        KubeClient.CoordinationV1(),
+		identity:      identity,
+		leaseDuration: time.Duration(config.LeaseDurationInSecs) * time.Second,
+		renewDeadline: time.Duration(config.RenewDeadlineInSecs) * time.Second,
+		retryPeriod:   time.Duration(config.RetryPeriodInSecs) * time.Second,
+	}
+	return LeaderClient
+}
+
+// IsLeader 返回当前副本是否为 leader，未开启选举时总是返回 true
+func IsLeader() bool {
+	if !embed.Env.LeaderElection.Enabled {
+		return true
+	}
+	return LeaderClient != nil && LeaderClient.IsLeader()
+}
+
+// IsLeader 在超过 renewDeadline 未续约时返回 false，不必等到下一次续约失败，
+// 以免其他副本在 lease 过期后接管时两个副本同时认为自己是 leader
+func (l *LeaderElector) IsLeader() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.leader && time.Since(l.lastRenewTime) < l.renewDeadline
+}
+
+func (l *LeaderElector) Run(stopCh <-chan struct{}) {
+	defer runtime.HandleCrash()
+
+	if !embed.Env.LeaderElection.Enabled {
+		glog.Info("Leader election is disabled")
+		metrics.Leader.Set(1)
+		return
+	}
+	glog.Infof("Started leader election, identity: %s", l.identity)
+	wait.Until(l.tryAcquireOrRenew, l.retryPeriod, stopCh)
+	l.release()
+	glog.Info("Shutting down leader election")
+}
+
+func (l *LeaderElector) tryAcquireOrRenew() {
+	now := time.Now()
+	leases := l.client.Leases(embed.Env.RegisterServerNamespace)
+	lease, err := leases.Get(entity.RegisterServerName, metaV1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			glog.Warningf("Get leader lease failed: %v", err)
+			l.renewFailed(now)
+			return
+		}
+		lease = &coordinationV1.Lease{
+			ObjectMeta: metaV1.ObjectMeta{
+				Namespace: embed.Env.RegisterServerNamespace,
+				Name:      entity.RegisterServerName,
+			},
+			Spec: l.leaseSpec(now, nil),
+		}
+		if _, err := leases.Create(lease); err != nil {
+			glog.Warningf("Create leader lease failed: %v", err)
+			l.renewFailed(now)
+			return
+		}
+		l.renewSucceeded(now)
+		return
+	}
+
+	if !l.canAcquire(&lease.Spec, now) {
+		l.setLeader(false)
+		return
+	}
+	lease.Spec = l.leaseSpec(now, &lease.Spec)
+	// Update 携带上面读取到的 resourceVersion，并发竞争时只有一个副本能成功
+	if _, err := leases.Update(lease); err != nil {
+		glog.Warningf("Update leader lease failed: %v", err)
+		l.renewFailed(now)
+		return
+	}
+	l.renewSucceeded(now)
+}
+
+// canAcquire 在 lease 由当前副本持有、无人持有或已过期时返回 true
+func (l *LeaderElector) canAcquire(spec *coordinationV1.LeaseSpec, now time.Time) bool {
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || *spec.HolderIdentity == l.identity {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.observedLease == nil || !sameLease(l.observedLease, spec) {
+		l.observedLease = spec.DeepCopy()
+		l.observedTime = now
+	}
+	duration := l.leaseDuration
+	if spec.LeaseDurationSeconds != nil {
+		duration = time.Duration(*spec.LeaseDurationSeconds) * time.Second
+	}
+	return l.observedTime.Add(duration).Before(now)
+}
+
+func sameLease(a *coordinationV1.LeaseSpec, b *coordinationV1.LeaseSpec) bool {
+	return *a.HolderIdentity == *b.HolderIdentity && a.RenewTime.Equal(b.RenewTime)
+}
+
+func (l *LeaderElector) leaseSpec(now time.Time, old *coordinationV1.LeaseSpec) coordinationV1.LeaseSpec {
+	identity := l.identity
+	duration := int32(l.leaseDuration / time.Second)
+	renewTime := metaV1.NewMicroTime(now)
+	spec := coordinationV1.LeaseSpec{
+		HolderIdentity:       &identity,
+		LeaseDurationSeconds: &duration,
+		AcquireTime:          &renewTime,
+		RenewTime:            &renewTime,
+	}
+	if old == nil {
+		return spec
+	}
+	spec.LeaseTransitions = old.LeaseTransitions
+	if old.HolderIdentity != nil && *old.HolderIdentity == identity && old.AcquireTime != nil {
+		spec.AcquireTime = old.AcquireTime
+	} else {
+		transitions := int32(1)
+		if old.LeaseTransitions != nil {
+			transitions = *old.LeaseTransitions + 1
+		}
+		spec.LeaseTransitions = &transitions
+	}
+	return spec
+}
+
+func (l *LeaderElector) renewSucceeded(now time.Time) {
+	l.lock.Lock()
+	l.lastRenewTime = now
+	l.lock.Unlock()
+	l.setLeader(true)
+}
+
+// renewFailed 在超过 renewDeadline 未能续约时退出 leader，renewDeadline 小于 leaseDuration，
+// 保证其他副本在 lease 过期后接管之前当前副本已经退出
+func (l *LeaderElector) renewFailed(now time.Time) {
+	l.lock.Lock()
+	expired := l.lastRenewTime.Add(l.renewDeadline).Before(now)
+	l.lock.Unlock()
+	if expired {
+		l.setLeader(false)
+	}
+}
+
+func (l *LeaderElector) setLeader(leader bool) {
+	l.lock.Lock()
+	changed := l.leader != leader
+	l.leader = leader
+	l.lock.Unlock()
+	if !changed {
+		return
+	}
+	if leader {
+		metrics.Leader.Set(1)
+		glog.Infof("%s became the leader", l.identity)
+	} else {
+		metrics.Leader.Set(0)
+		glog.Infof("%s is no longer the leader", l.identity)
+	}
+}
+
+// release 在关闭时清空持有者，其他副本无需等待过期即可接管
+func (l *LeaderElector) release() {
+	if !l.IsLeader() {
+		return
+	}
+	leases := l.client.Leases(embed.Env.RegisterServerNamespace)
+	lease, err := leases.Get(entity.RegisterServerName, metaV1.GetOptions{})
+	if err != nil || lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.identity {
+		return
+	}
+	empty := ""
+	lease.Spec.HolderIdentity = &empty
+	if _, err := leases.Update(lease); err != nil {
+		glog.Warningf("Release leader lease failed: %v", err)
+	}
+	l.setLeader(false)
+}
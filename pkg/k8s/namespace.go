@@ -0,0 +1,170 @@
+package k8s
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	coreListeners "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+	"github.com/choerodon/go-register-server/pkg/embed"
+)
+
+var NamespaceClient *NamespaceOperator
+
+// NamespaceOperator 除了 register.service.namespace 中列出的命名空间，
+// 还监听标签匹配 register.service.namespaceSelector 的命名空间。
+// 命名空间加上标签时启动其 informer，去掉标签时注销其中的对象并停止 informer
+type NamespaceOperator struct {
+	namespacesLister coreListeners.NamespaceLister
+	namespacesSynced cache.InformerSynced
+	selector         labels.Selector
+
+	lock sync.RWMutex
+	// selected 保存当前与选择器匹配的命名空间
+	selected map[string]bool
+}
+
+func NewNamespaceOperator() (*NamespaceOperator, error) {
+	if NamespaceClient != nil {
+		return NamespaceClient, nil
+	}
+	selector, err := labels.Parse(embed.Env.RegisterServiceNamespaceSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespace selector %q: %v", embed.Env.RegisterServiceNamespaceSelector, err)
+	}
+	namespaceInformer := KubeInformerFactory.Core().V1().Namespaces()
+	NamespaceClient = &NamespaceOperator{
+		namespacesLister: namespaceInformer.Lister(),
+		namespacesSynced: namespaceInformer.Informer().HasSynced,
+		selector:         selector,
+		selected:         make(map[string]bool),
+	}
+	namespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: NamespaceClient.update,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			NamespaceClient.update(newObj)
+		},
+		DeleteFunc: NamespaceClient.delete,
+	})
+	return NamespaceClient, nil
+}
+
+func (c *NamespaceOperator) StartMonitor(stopCh <-chan struct{}) {
+	defer runtime.HandleCrash()
+
+	if ok := cache.WaitForCacheSync(stopCh, c.namespacesSynced); !ok {
+		glog.Error("failed to wait for caches to sync")
+		return
+	}
+	glog.Infof("Started k8s namespace monitor, selector: %s", c.selector)
+	<-stopCh
+	glog.Info("Shutting down k8s namespace monitor")
+}
+
+func (c *NamespaceOperator) update(obj interface{}) {
+	namespace, ok := obj.(*coreV1.Namespace)
+	if !ok {
+		return
+	}
+	c.setSelected(namespace.Name, namespace.DeletionTimestamp == nil && c.selector.Matches(labels.Set(namespace.Labels)))
+}
+
+func (c *NamespaceOperator) delete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if namespace, ok := obj.(*coreV1.Namespace); ok {
+		c.setSelected(namespace.Name, false)
+	}
+}
+
+func (c *NamespaceOperator) setSelected(namespace string, selected bool) {
+	c.lock.Lock()
+	changed := c.selected[namespace] != selected
+	if selected {
+		c.selected[namespace] = true
+	} else {
+		delete(c.selected, namespace)
+	}
+	c.lock.Unlock()
+	if !changed || embed.Env.IsRegisterServiceNamespace(namespace) {
+		return
+	}
+	if selected {
+		glog.Infof("Namespace %s matches selector %s, start watching", namespace, c.selector)
+		Informers.Watch(namespace)
+	} else {
+		glog.Infof("Namespace %s no longer matches selector %s, stop watching", namespace, c.selector)
+		// 先注销命名空间中的对象，再丢弃缓存
+		resyncNamespace(namespace)
+		Informers.Unwatch(namespace)
+	}
+}
+
+func (c *NamespaceOperator) isSelected(namespace string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.selected[namespace]
+}
+
+// IsWatchedNamespace 返回命名空间中的 pod、ConfigMap 与 Endpoints 是否会被注册
+func IsWatchedNamespace(namespace string) bool {
+	if embed.Env.IsRegisterServiceNamespace(namespace) {
+		return true
+	}
+	return NamespaceClient != nil && NamespaceClient.isSelected(namespace)
+}
+
+// WatchedNamespaces 返回按名称排序的被监听命名空间，以及各自被监听的原因
+func WatchedNamespaces() []*entity.WatchedNamespace {
+	reasons := make(map[string]string)
+	if NamespaceClient != nil {
+		NamespaceClient.lock.RLock()
+		for namespace := range NamespaceClient.selected {
+			reasons[namespace] = fmt.Sprintf("matches label selector %s", NamespaceClient.selector)
+		}
+		NamespaceClient.lock.RUnlock()
+	}
+	for _, namespace := range embed.Env.RegisterServiceNamespace {
+		reasons[namespace] = "listed in register.service.namespace"
+	}
+	namespaces := make([]*entity.WatchedNamespace, 0, len(reasons))
+	for namespace, reason := range reasons {
+		namespaces = append(namespaces, &entity.WatchedNamespace{Name: namespace, Reason: reason})
+	}
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].Name < namespaces[j].Name
+	})
+	return namespaces
+}
+
+// WatchedNamespaceNames 返回被监听命名空间的名称
+func WatchedNamespaceNames() []string {
+	namespaces := WatchedNamespaces()
+	names := make([]string, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		names = append(names, namespace.Name)
+	}
+	return names
+}
+
+// resyncNamespace 将命名空间中已缓存的对象重新入队，
+// 由于命名空间不再被监听，operator 会注销这些对象
+func resyncNamespace(namespace string) {
+	if PodClient != nil {
+		PodClient.enqueueNamespace(namespace)
+	}
+	if ConfigMapClient != nil {
+		ConfigMapClient.enqueueNamespace(namespace)
+	}
+	if EndpointsClient != nil {
+		EndpointsClient.enqueueNamespace(namespace)
+	}
+}
@@ -0,0 +1,154 @@
+package k8s
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreListeners "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/choerodon/go-register-server/pkg/embed"
+	"github.com/choerodon/go-register-server/pkg/utils"
+)
+
+var NodeClient *NodeOperator
+
+// NodeOperator 在节点 NotReady 或失联超过 eureka.nodeFailure.gracePeriod 后将其上 pod 的实例标记为故障，
+// k8s 需要数分钟才会驱逐故障节点上的 pod，节点恢复 Ready 后实例随之恢复
+type NodeOperator struct {
+	nodesLister coreListeners.NodeLister
+	nodesSynced cache.InformerSynced
+	workQueue   workqueue.RateLimitingInterface
+	gracePeriod time.Duration
+
+	lock sync.RWMutex
+	// failed 保存 NotReady 超过宽限期的节点
+	failed map[string]bool
+}
+
+func NewNodeOperator() *NodeOperator {
+	if NodeClient != nil {
+		return NodeClient
+	}
+	nodeInformer := KubeInformerFactory.Core().V1().Nodes()
+	NodeClient = &NodeOperator{
+		nodesLister: nodeInformer.Lister(),
+		nodesSynced: nodeInformer.Informer().HasSynced,
+		workQueue:   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Nodes"),
+		gracePeriod: time.Duration(embed.Env.Eureka.NodeFailure.GracePeriodInSecs) * time.Second,
+		failed:      make(map[string]bool),
+	}
+	nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: NodeClient.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			NodeClient.enqueue(newObj)
+		},
+		DeleteFunc: NodeClient.enqueue,
+	})
+	return NodeClient
+}
+
+func (c *NodeOperator) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.workQueue.Add(key)
+}
+
+func (c *NodeOperator) StartMonitor(stopCh <-chan struct{}) {
+	defer runtime.HandleCrash()
+	defer c.workQueue.ShutDown()
+
+	if ok := cache.WaitForCacheSync(stopCh, c.nodesSynced); !ok {
+		glog.Error("failed to wait for caches to sync")
+		return
+	}
+
+	glog.Infof("Started k8s node monitor, grace period: %s", c.gracePeriod)
+	go wait.Until(func() {
+		for c.processNextWorkItem() {
+		}
+	}, time.Second, stopCh)
+
+	<-stopCh
+	glog.Info("Shutting down k8s node monitor")
+}
+
+func (c *NodeOperator) processNextWorkItem() bool {
+	key, shutdown := c.workQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.workQueue.Done(key)
+
+	if err := c.syncHandler(key.(string)); err != nil {
+		runtime.HandleError(fmt.Errorf("error syncing node '%s': %s", key, err.Error()))
+		c.workQueue.AddRateLimited(key)
+		return true
+	}
+	c.workQueue.Forget(key)
+	return true
+}
+
+func (c *NodeOperator) syncHandler(name string) error {
+	failed := false
+	node, err := c.nodesLister.Get(name)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	// 被删除节点上的 pod 很快也会被删除，届时其实例随之注销
+	if err == nil {
+		failed = c.isNodeFailed(node)
+	}
+
+	c.lock.Lock()
+	changed := c.failed[name] != failed
+	if failed {
+		c.failed[name] = true
+	} else {
+		delete(c.failed, name)
+	}
+	c.lock.Unlock()
+	if !changed {
+		return nil
+	}
+	if failed {
+		glog.Warningf("Node %s is not ready for more than %s, mark its instances %s",
+			name, c.gracePeriod, embed.Env.Eureka.NodeFailure.Status)
+	} else {
+		glog.Infof("Node %s recovered, restore its instances", name)
+	}
+	if PodClient != nil {
+		PodClient.enqueueNode(name)
+	}
+	return nil
+}
+
+// isNodeFailed 返回节点 NotReady 是否已超过宽限期，未超过时在宽限期结束后重新检查
+func (c *NodeOperator) isNodeFailed(node *coreV1.Node) bool {
+	since, notReady := utils.NodeNotReadySince(node)
+	if !notReady {
+		return false
+	}
+	if remaining := c.gracePeriod - time.Since(since); remaining > 0 {
+		c.workQueue.AddAfter(node.Name, remaining)
+		return false
+	}
+	return true
+}
+
+// IsFailed 返回节点上 pod 的实例是否应标记为故障
+func (c *NodeOperator) IsFailed(name string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.failed[name]
+}
@@ -0,0 +1,217 @@
+package k8s
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	coreListeners "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+	"github.com/choerodon/go-register-server/pkg/api/metrics"
+	"github.com/choerodon/go-register-server/pkg/api/repository"
+	"github.com/choerodon/go-register-server/pkg/embed"
+	"github.com/choerodon/go-register-server/pkg/utils"
+)
+
+var PeerClient *PeerNodes
+
+// PeerNodes 通过 pod 发现其他 go-register-server 副本，
+// 并将实例的注册、续约、下线与状态覆盖操作批量同步给它们
+type PeerNodes struct {
+	podsLister coreListeners.PodLister
+	podsSynced cache.InformerSynced
+	appRepo    *repository.ApplicationRepository
+	selfName   string
+	tasks      chan *entity.ReplicationInstance
+	httpClient *http.Client
+}
+
+func NewPeerNodes() *PeerNodes {
+	if PeerClient != nil {
+		return PeerClient
+	}
+	podInformer := Informers.PeerPods()
+	selfName, err := os.Hostname()
+	if err != nil {
+		glog.Warningf("Get hostname of current pod failed: %v", err)
+	}
+	PeerClient = &PeerNodes{
+		podsLister: podInformer.Lister(),
+		podsSynced: podInformer.Informer().HasSynced,
+		appRepo:    AppRepo,
+		selfName:   selfName,
+		tasks:      make(chan *entity.ReplicationInstance, 10*embed.Env.Eureka.Peer.BatchSize),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+	return PeerClient
+}
+
+// Replicate 将操作加入同步队列，队列已满时丢弃，
+// 实例下一次续约时其他副本会重新达成一致
+func (p *PeerNodes) Replicate(task *entity.ReplicationInstance) {
+	if !embed.Env.Eureka.Peer.Enabled {
+		return
+	}
+	select {
+	case p.tasks <- task:
+	default:
+		metrics.PeerReplicationCount.With(prometheus.Labels{"result": "dropped"}).Inc()
+		glog.Warningf("Replication queue is full, drop %s of instance %s", task.Action, task.Id)
+	}
+}
+
+// ReplicateInstance 将携带实例当前状态的 Register 操作加入同步队列
+func (p *PeerNodes) ReplicateInstance(instance *entity.Instance) {
+	p.Replicate(&entity.ReplicationInstance{
+		AppName:            instance.App,
+		Id:                 instance.InstanceId,
+		LastDirtyTimestamp: instance.LastDirtyTimestamp,
+		InstanceInfo:       instance,
+		Action:             entity.ReplicationRegister,
+	})
+}
+
+func (p *PeerNodes) StartReplication(stopCh <-chan struct{}) {
+	defer runtime.HandleCrash()
+
+	if !embed.Env.Eureka.Peer.Enabled {
+		glog.Info("Peer replication is disabled")
+		return
+	}
+	if ok := cache.WaitForCacheSync(stopCh, p.podsSynced); !ok {
+		glog.Error("failed to wait for caches to sync")
+		return
+	}
+
+	glog.Info("Started peer replication")
+	batchSize := embed.Env.Eureka.Peer.BatchSize
+	maxDelay := time.Duration(embed.Env.Eureka.Peer.MaxBatchingDelayInMs) * time.Millisecond
+	for {
+		select {
+		case <-stopCh:
+			glog.Info("Shutting down peer replication")
+			return
+		case task := <-p.tasks:
+			batch := []*entity.ReplicationInstance{task}
+			timeout := time.After(maxDelay)
+		collect:
+			for len(batch) < batchSize {
+				select {
+				case task := <-p.tasks:
+					batch = append(batch, task)
+				case <-timeout:
+					break collect
+				}
+			}
+			p.sendBatch(batch)
+		}
+	}
+}
+
+// PeerUrls 返回其他运行中且已就绪的副本的地址
+func (p *PeerNodes) PeerUrls() []string {
+	pods, err := p.podsLister.Pods(embed.Env.RegisterServerNamespace).List(labels.Everything())
+	if err != nil {
+		glog.Warningf("List peer pods failed: %v", err)
+		return nil
+	}
+	keys := LabelKeys()
+	urls := make([]string, 0, len(pods))
+	for _, pod := range pods {
+		if service, _ := keys.LookupService(pod.Labels); service != entity.RegisterServerName {
+			continue
+		}
+		if pod.Name == p.selfName || !isPeerReady(pod) {
+			continue
+		}
+		ip := utils.SelectPodIP(pod, embed.Env.Eureka.IpFamilyPolicy)
+		urls = append(urls, utils.BaseUrl("http", ip, entity.RegisterServerPort)+"/eureka/")
+	}
+	return urls
+}
+
+func isPeerReady(pod *coreV1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != coreV1.PodRunning || pod.Status.PodIP == "" {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == coreV1.PodReady {
+			return condition.Status == coreV1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func (p *PeerNodes) sendBatch(batch []*entity.ReplicationInstance) {
+	body, err := json.Marshal(&entity.ReplicationList{ReplicationList: batch})
+	if err != nil {
+		glog.Warningf("Marshal replication batch failed: %v", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, peerUrl := range p.PeerUrls() {
+		wg.Add(1)
+		go func(peerUrl string) {
+			defer wg.Done()
+			responses, err := p.post(peerUrl+"peerreplication/batch", body)
+			if err != nil {
+				metrics.PeerReplicationCount.With(prometheus.Labels{"result": "failure"}).Add(float64(len(batch)))
+				glog.Warningf("Replicate %d tasks to peer %s failed: %v", len(batch), peerUrl, err)
+				return
+			}
+			metrics.PeerReplicationCount.With(prometheus.Labels{"result": "success"}).Add(float64(len(batch)))
+			p.handleResponses(batch, responses)
+		}(peerUrl)
+	}
+	wg.Wait()
+}
+
+func (p *PeerNodes) post(url string, body []byte) (*entity.ReplicationListResponse, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(entity.ReplicationHeader, "true")
+	res, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("statusCode: %d", res.StatusCode)
+	}
+	responses := &entity.ReplicationListResponse{}
+	if err := json.NewDecoder(res.Body).Decode(responses); err != nil {
+		return nil, err
+	}
+	return responses, nil
+}
+
+// handleResponses 将对方副本不存在的实例重新注册过去，
+// 例如在实例注册之后才启动的副本
+func (p *PeerNodes) handleResponses(batch []*entity.ReplicationInstance, responses *entity.ReplicationListResponse) {
+	for i, response := range responses.ResponseList {
+		if i >= len(batch) {
+			return
+		}
+		if response.StatusCode != http.StatusNotFound || batch[i].Action != entity.ReplicationHeartbeat {
+			continue
+		}
+		if instance := p.appRepo.GetStoredInstance(batch[i].Id); instance != nil {
+			p.ReplicateInstance(instance)
+		}
+	}
+}
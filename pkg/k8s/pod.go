@@ -8,6 +8,7 @@ import (
 	"github.com/golang/glog"
 	coreV1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	coreListeners "k8s.io/client-go/listers/core/v1"
@@ -17,38 +18,71 @@ import (
 	"github.com/choerodon/go-register-server/pkg/api/entity"
 	"github.com/choerodon/go-register-server/pkg/api/repository"
 	"github.com/choerodon/go-register-server/pkg/utils"
-	"strings"
 )
 
 var PodClient *PodOperator
 
+// LabelKeys 返回配置的描述服务信息的标签与注解的键
+func LabelKeys() utils.LabelKeys {
+	return utils.LabelKeys(embed.Env.Labels)
+}
+
 type PodOperatorInterface interface {
 	StartMonitor(stopCh <-chan struct{})
 }
 
 type PodOperator struct {
-	podsLister coreListeners.PodLister
+	podsLister podListers
 	podsSynced cache.InformerSynced
 	workQueue  workqueue.RateLimitingInterface
 	appRepo    *repository.ApplicationRepository
+	options    utils.PodConvertOptions
+	// 开启 eureka.zone.enabled 时设置，pod 的可用区与地域取自其所在节点
+	nodesLister coreListeners.NodeLister
 }
 
 func NewPodAgent() PodOperatorInterface {
 	if PodClient != nil {
 		return PodClient
 	}
-	podInformer := KubeInformerFactory.Core().V1().Pods()
-
 	PodClient = &PodOperator{
-		podsLister: podInformer.Lister(),
-		podsSynced: podInformer.Informer().HasSynced,
+		podsLister: Informers,
+		podsSynced: Informers.HasSynced,
 		workQueue:  workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Pods"),
 		appRepo:    AppRepo,
+		options: utils.PodConvertOptions{
+			InstanceIdScheme:  embed.Env.Eureka.InstanceIdScheme,
+			TerminatingStatus: embed.Env.Eureka.TerminatingStatus,
+			IpFamilyPolicy:    embed.Env.Eureka.IpFamilyPolicy,
+			LabelKeys:         LabelKeys(),
+			MetadataPrefixes:  embed.Env.Eureka.Metadata.Prefixes,
+			MetadataKeys:      embed.Env.Eureka.Metadata.Keys,
+		},
+	}
+
+	if embed.Env.Eureka.Zone.Enabled {
+		nodeInformer := KubeInformerFactory.Core().V1().Nodes()
+		PodClient.nodesLister = nodeInformer.Lister()
+		nodesSynced := nodeInformer.Informer().HasSynced
+		PodClient.podsSynced = func() bool {
+			return Informers.HasSynced() && nodesSynced()
+		}
+		// 节点的拓扑标签变化时刷新其上 pod 的可用区与地域
+		nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldNode, newNode := oldObj.(*coreV1.Node), newObj.(*coreV1.Node)
+				oldZone, oldRegion := utils.NodeTopology(oldNode)
+				newZone, newRegion := utils.NodeTopology(newNode)
+				if oldZone != newZone || oldRegion != newRegion {
+					PodClient.enqueueNode(newNode.Name)
+				}
+			},
+		})
 	}
 
 	glog.Info("Setting up event handlers")
 
-	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+	Informers.AddEventHandler(podResource, cache.ResourceEventHandlerFuncs{
 		AddFunc: PodClient.enqueuePod,
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			newPod := newObj.(*coreV1.Pod)
@@ -74,6 +108,35 @@ func (c *PodOperator) enqueuePod(obj interface{}) {
 	c.workQueue.AddRateLimited(key)
 }
 
+func (c *PodOperator) enqueueNamespace(namespace string) {
+	pods, err := c.podsLister.Pods(namespace).List(labels.Everything())
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	for _, pod := range pods {
+		c.enqueuePod(pod)
+	}
+}
+
+// enqueueNode 将节点上已注册实例的 pod 重新入队
+func (c *PodOperator) enqueueNode(nodeName string) {
+	c.appRepo.InstanceStore.Range(func(key, value interface{}) bool {
+		podKey, ok := value.(*entity.Instance).Metadata["pod-self-link"]
+		if !ok {
+			return true
+		}
+		namespace, name, err := cache.SplitMetaNamespaceKey(podKey)
+		if err != nil {
+			return true
+		}
+		if pod, err := c.podsLister.Pods(namespace).Get(name); err == nil && pod.Spec.NodeName == nodeName {
+			c.enqueuePod(pod)
+		}
+		return true
+	})
+}
+
 func (c *PodOperator) StartMonitor(stopCh <-chan struct{}) {
 	defer runtime.HandleCrash()
 	defer c.workQueue.ShutDown()
@@ -121,28 +184,22 @@ func (c *PodOperator) processNextWorkItem() bool {
 
 func (c *PodOperator) syncHandler(key string) (bool, error) {
 	namespace, name, err := cache.SplitMetaNamespaceKey(key)
-	matchNum := 0
-	for _, ns := range embed.Env.RegisterServiceNamespace {
-		if strings.Compare(ns, namespace) == 0 {
-			matchNum++
-		}
-	}
-	if matchNum < 1 {
-		return true, nil
-	}
 	if err != nil {
 		runtime.HandleError(fmt.Errorf("invalid resource key: %s", key))
 		return true, nil
 	}
+	if !IsWatchedNamespace(namespace) {
+		// 命名空间可能已去掉了选择器匹配的标签
+		if _, ok := c.appRepo.NamespaceStore.Load(key); ok {
+			c.deleteInstance(key)
+		}
+		return true, nil
+	}
 
 	pod, err := c.podsLister.Pods(namespace).Get(name)
 	if err != nil {
 		if errors.IsNotFound(err) {
-			if ins := c.appRepo.DeleteInstance(key); ins != nil {
-				DeleteInstanceFromConfigMap(ins.InstanceId)
-				ins.Status = entity.DOWN
-				glog.Info(key, " DOWN")
-			}
+			c.deleteInstance(key)
 			runtime.HandleError(fmt.Errorf("pod '%s' in work queue no longer exists", key))
 			return true, nil
 		}
@@ -150,32 +207,55 @@ func (c *PodOperator) syncHandler(key string) (bool, error) {
 		return false, err
 	}
 
-	_, isContainServiceLabel := pod.Labels[entity.ChoerodonService]
-	_, isContainVersionLabel := pod.Labels[entity.ChoerodonVersion]
-	_, isContainPortLabel := pod.Labels[entity.ChoerodonPort]
+	_, isContainServiceLabel := c.options.LabelKeys.LookupService(pod.Labels)
+	_, isContainVersionLabel := c.options.LabelKeys.LookupVersion(pod.Labels)
+	_, isContainPortLabel := c.options.LabelKeys.LookupManagementPort(pod.Labels)
 
-	if !isContainServiceLabel || !isContainVersionLabel || !isContainPortLabel {
-		return true, nil
-	}
-
-	if pod.Status.ContainerStatuses == nil {
+	if !isContainServiceLabel || !isContainVersionLabel || !isContainPortLabel || len(pod.Spec.Containers) == 0 {
+		// 已注册的 pod 去掉了标签时注销其实例
+		if _, ok := c.appRepo.NamespaceStore.Load(key); ok {
+			c.deleteInstance(key)
+		}
 		return true, nil
 	}
 
-	if container := pod.Status.ContainerStatuses[0]; container.Ready && container.State.Running != nil && len(pod.Spec.Containers) > 0 {
-		if in := utils.ConvertPod2Instance(pod); c.appRepo.Register(in, key) {
-			ins := *in
-			ins.Status = entity.UP
-			glog.Info(key, " UP ")
+	if status := utils.PodInstanceStatus(pod, c.options); len(status) > 0 {
+		in := utils.ConvertPod2Instance(pod, c.options)
+		c.setTopology(in, pod)
+		if NodeClient != nil && NodeClient.IsFailed(pod.Spec.NodeName) {
+			in.Status = embed.Env.Eureka.NodeFailure.Status
+		}
+		if c.appRepo.Register(in, key) {
+			glog.Info(key, " ", in.Status)
 		}
 
 	} else {
-		if ins := c.appRepo.DeleteInstance(key); ins != nil {
+		c.deleteInstance(key)
+	}
+
+	return true, nil
+}
+
+func (c *PodOperator) deleteInstance(key string) {
+	if ins := c.appRepo.DeleteInstance(key); ins != nil {
+		if IsLeader() {
 			DeleteInstanceFromConfigMap(ins.InstanceId)
-			ins.Status = entity.DOWN
-			glog.Info(key, " DOWN")
 		}
+		ins.Status = entity.DOWN
+		glog.Info(key, " DOWN")
 	}
+}
 
-	return true, nil
+// setTopology 将 pod 所在节点的可用区与地域设置到实例上，找不到节点时实例不带这些信息注册
+func (c *PodOperator) setTopology(instance *entity.Instance, pod *coreV1.Pod) {
+	if c.nodesLister == nil || len(pod.Spec.NodeName) == 0 {
+		return
+	}
+	node, err := c.nodesLister.Get(pod.Spec.NodeName)
+	if err != nil {
+		glog.Warningf("Get node %s of pod %s/%s error: %v", pod.Spec.NodeName, pod.Namespace, pod.Name, err)
+		return
+	}
+	zone, region := utils.NodeTopology(node)
+	utils.SetInstanceTopology(instance, zone, region)
 }
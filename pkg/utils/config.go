@@ -1,6 +1,10 @@
 package utils
 
-import "github.com/choerodon/go-register-server/pkg/api/entity"
+import (
+	"strings"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+)
 
 func ConfigMapProfileKey(profile string) string {
 	application := "application"
@@ -9,3 +13,11 @@ func ConfigMapProfileKey(profile string) string {
 	}
 	return application + ".yml"
 }
+
+// instanceKeyReplacer 将实例 id 中 cm 的键不允许的字符替换掉，IPv6 实例 id 中的方括号替换为下划线
+var instanceKeyReplacer = strings.NewReplacer(":", "-", "[", "_", "]", "_")
+
+// ConfigMapInstanceKey 返回实例保存在注册中心 cm 中使用的键
+func ConfigMapInstanceKey(instanceId string) string {
+	return instanceKeyReplacer.Replace(instanceId)
+}
@@ -6,7 +6,11 @@ import (
 	"fmt"
 	"github.com/choerodon/go-register-server/pkg/api/entity"
 	"k8s.io/api/core/v1"
+	"net"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -25,26 +29,36 @@ func ImpInstance(instance *entity.Instance) {
 		instance.Metadata["provisioner"] = "custom"
 	}
 
+	scheme, homePort := "http", instance.Port.Port
+	if instance.SecurePort.Enabled {
+		scheme, homePort = "https", instance.SecurePort.Port
+	}
 	if len(instance.HomePageUrl) == 0 {
-		instance.HomePageUrl = fmt.Sprintf("http://%s:%d/",
-			instance.IPAddr, instance.Port.Port)
+		instance.HomePageUrl = BaseUrl(scheme, instance.IPAddr, homePort) + "/"
 	}
+	// 管理端口默认不使用 https
 	if len(instance.StatusPageUrl) == 0 {
-		instance.StatusPageUrl = fmt.Sprintf("http://%s:%d/actuator/info",
-			instance.IPAddr, instance.Port.Port+1)
+		instance.StatusPageUrl = BaseUrl("http", instance.IPAddr, instance.Port.Port+1) + "/actuator/info"
 	}
 	if len(instance.HealthCheckUrl) == 0 {
-		instance.HealthCheckUrl = fmt.Sprintf("http://%s:%d/actuator/health",
-			instance.IPAddr, instance.Port.Port+1)
+		instance.HealthCheckUrl = BaseUrl("http", instance.IPAddr, instance.Port.Port+1) + "/actuator/health"
 	}
 
 	instance.HostName = instance.IPAddr
-	instance.OverriddenStatus = entity.UNKNOWN
+	if len(instance.OverriddenStatus) == 0 {
+		instance.OverriddenStatus = entity.UNKNOWN
+	} else if instance.OverriddenStatus != entity.UNKNOWN {
+		instance.Status = instance.OverriddenStatus
+	}
 	instance.CountryId = 8
 	instance.ActionType = entity.ADDED
 	instance.IsCoordinatingDiscoveryServer = true
-	instance.VipAddress = instance.App
-	instance.SecureVipAddress = instance.App
+	if len(instance.VipAddress) == 0 {
+		instance.VipAddress = instance.App
+	}
+	if len(instance.SecureVipAddress) == 0 {
+		instance.SecureVipAddress = instance.VipAddress
+	}
 	instance.DataCenterInfo = entity.DataCenterInfo{
 		Class: entity.DATA_CENTRE_CLASS,
 		Name:  entity.DATA_CENTRE_NAME,
@@ -63,40 +77,211 @@ func ImpInstance(instance *entity.Instance) {
 	instance.LastDirtyTimestamp = now
 }
 
-func ConvertPod2Instance(pod *v1.Pod) *entity.Instance {
+// 实例 id 的生成方式
+const (
+	// ip:服务名:端口，与 eureka 客户端默认的实例 id 一致
+	InstanceIdSchemeIp = "ip"
+	// pod名.namespace:服务名:端口，pod ip 被复用时也不会冲突，且 pod 重建前保持不变
+	InstanceIdSchemePod = "pod"
+)
+
+// 双栈集群中实例注册的 ip 地址族
+const (
+	// 使用 pod 的主 ip，即 status.podIP
+	IpFamilyPolicyPrimary = "primary"
+	// 优先使用 IPv4 地址，pod 没有 IPv4 地址时使用主 ip
+	IpFamilyPolicyIpv4 = "ipv4"
+	// 优先使用 IPv6 地址，pod 没有 IPv6 地址时使用主 ip
+	IpFamilyPolicyIpv6 = "ipv6"
+)
+
+// 实例元数据中记录的各地址族的 ip
+const (
+	Ipv4MetadataKey = "ipv4"
+	Ipv6MetadataKey = "ipv6"
+)
+
+// PodConvertOptions 是 pod 转换为实例时的配置
+type PodConvertOptions struct {
+	InstanceIdScheme string
+	// 双栈 pod 注册的 ip 地址族，primary、ipv4 或 ipv6
+	IpFamilyPolicy string
+	// 正在删除的 pod 对应实例的状态，DOWN 或 OUT_OF_SERVICE
+	TerminatingStatus string
+	LabelKeys         LabelKeys
+	// 以这些前缀开头的标签与注解去掉前缀后复制到实例的元数据
+	MetadataPrefixes []string
+	// 复制到实例元数据的标签与注解，元数据的键为最后一个 / 之后的部分
+	MetadataKeys []string
+}
+
+// ReservedMetadataKeys 是实例元数据中由注册中心维护的键，不能被标签、注解与元数据修改接口覆盖
+var ReservedMetadataKeys = map[string]bool{
+	"provisioner":         true,
+	"pod-self-link":       true,
+	"endpoints-self-link": true,
+	"version":             true,
+	"context-path":        true,
+	Ipv4MetadataKey:       true,
+	Ipv6MetadataKey:       true,
+}
+
+// metadataKey 返回标签或注解复制到元数据时使用的键
+func (options PodConvertOptions) metadataKey(key string) (string, bool) {
+	for _, prefix := range options.MetadataPrefixes {
+		if len(prefix) > 0 && len(key) > len(prefix) && strings.HasPrefix(key, prefix) {
+			return key[len(prefix):], true
+		}
+	}
+	for _, metadataKey := range options.MetadataKeys {
+		if metadataKey == key {
+			return key[strings.LastIndex(key, "/")+1:], true
+		}
+	}
+	return "", false
+}
+
+// copyMetadata 将选中的标签与注解复制到实例的元数据，后面的来源优先，保留的键不会被覆盖
+func copyMetadata(metadata entity.Metadata, options PodConvertOptions, sources ...map[string]string) {
+	for _, source := range sources {
+		for key, value := range source {
+			if metadataKey, ok := options.metadataKey(key); ok && !ReservedMetadataKeys[metadataKey] {
+				metadata[metadataKey] = value
+			}
+		}
+	}
+}
+
+func ConvertPod2Instance(pod *v1.Pod, options PodConvertOptions) *entity.Instance {
+	serviceName, _ := options.LabelKeys.LookupService(pod.Labels)
+	container := SelectServiceContainer(pod, options.LabelKeys)
+	port := SelectServicePort(pod, container)
+	status := PodInstanceStatus(pod, options)
+	if len(status) == 0 {
+		status = entity.DOWN
+	}
+	ip := SelectPodIP(pod, options.IpFamilyPolicy)
+	instanceId := IpInstanceId(ip, serviceName, port)
+	if options.InstanceIdScheme == InstanceIdSchemePod {
+		instanceId = fmt.Sprintf("%s.%s:%s:%d", pod.GetName(), pod.GetNamespace(), serviceName, port)
+	}
+	managementPort, _ := options.LabelKeys.LookupManagementPort(pod.Labels)
+	instance := newInstance(instanceId, ip, serviceName, port, SelectSecurePort(pod, container),
+		managementPort, isManagementSecure(pod.Annotations, pod.Labels), status, pod.Labels, options.LabelKeys)
+	setAddressMetadata(instance.Metadata, PodIPs(pod))
+	instance.Metadata["provisioner"] = entity.PodProvisioner
+	instance.Metadata["pod-self-link"] = fmt.Sprintf("%s/%s", pod.GetNamespace(), pod.GetName())
+	copyMetadata(instance.Metadata, options, pod.Labels, pod.Annotations)
+	return instance
+}
+
+// ConvertEndpoints2Instances 将 Service 的 Endpoints 转换为实例，就绪的地址为 UP，未就绪的地址为 STARTING。
+// 服务名、服务端口与管理端口取自 Service 的注解，未指定时分别使用 Service 名、名为 http 的端口或第一个端口、服务端口
+func ConvertEndpoints2Instances(service *v1.Service, endpoints *v1.Endpoints, options PodConvertOptions) []*entity.Instance {
+	annotations := service.Annotations
+	serviceName, _ := options.LabelKeys.LookupService(annotations)
+	if len(serviceName) == 0 {
+		serviceName = service.Name
+	}
+	instances := make([]*entity.Instance, 0)
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Ports) == 0 {
+			continue
+		}
+		port := SelectEndpointPort(subset.Ports, annotations[entity.ChoerodonPortAnnotation])
+		securePort := selectSecureEndpointPort(subset.Ports, service)
+		managementPort := strconv.Itoa(int(port))
+		if value, ok := options.LabelKeys.LookupManagementPort(annotations); ok {
+			managementPort = strconv.Itoa(int(SelectEndpointPort(subset.Ports, value)))
+		}
+		addresses := map[string][]v1.EndpointAddress{entity.UP: subset.Addresses, entity.STARTING: subset.NotReadyAddresses}
+		for status, addresses := range addresses {
+			for _, address := range addresses {
+				instanceId := IpInstanceId(address.IP, serviceName, port)
+				if options.InstanceIdScheme == InstanceIdSchemePod && address.TargetRef != nil && address.TargetRef.Kind == "Pod" {
+					instanceId = fmt.Sprintf("%s.%s:%s:%d", address.TargetRef.Name, address.TargetRef.Namespace, serviceName, port)
+				}
+				instance := newInstance(instanceId, address.IP, serviceName, port, securePort, managementPort,
+					isManagementSecure(annotations, service.Labels), status, annotations, options.LabelKeys)
+				setAddressMetadata(instance.Metadata, []string{address.IP})
+				instance.Metadata["provisioner"] = entity.EndpointsProvisioner
+				instance.Metadata["endpoints-self-link"] = fmt.Sprintf("%s/%s", endpoints.GetNamespace(), endpoints.GetName())
+				copyMetadata(instance.Metadata, options, service.Labels, service.Annotations)
+				instances = append(instances, instance)
+			}
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].InstanceId < instances[j].InstanceId
+	})
+	return instances
+}
+
+// SelectEndpointPort 选择 Endpoints 中的端口，value 可以是端口号或端口名，未指定或不存在时依次选择名为 http 的端口、第一个端口
+func SelectEndpointPort(ports []v1.EndpointPort, value string) int32 {
+	if port, err := strconv.ParseInt(value, 10, 32); err == nil {
+		return int32(port)
+	}
+	if len(ports) == 0 {
+		return 0
+	}
+	for _, name := range []string{value, entity.DefaultPortName} {
+		for _, port := range ports {
+			if len(name) > 0 && port.Name == name {
+				return port.Port
+			}
+		}
+	}
+	return ports[0].Port
+}
+
+// newInstance 生成 k8s 中发现的实例，vip 地址、版本与 context-path 取自 pod 的标签或 Service 的注解。
+// securePort 大于 0 时启用 https 端口，主页地址使用 https，与服务端口相同时不再启用 http 端口；
+// 管理端口单独配置，managementSecure 为 true 时状态页与健康检查地址才使用 https
+func newInstance(instanceId string, ip string, serviceName string, port int32, securePort int32, managementPort string,
+	managementSecure bool, status string, labels map[string]string, keys LabelKeys) *entity.Instance {
 	now := uint64(time.Now().UnixNano() / 1e6)
-	managementPort := pod.Labels[entity.ChoerodonPort]
-	serviceName := pod.Labels[entity.ChoerodonService]
-	var port int32
-	if container := pod.Spec.Containers[0]; len(container.Ports) > 0 {
-		port = pod.Spec.Containers[0].Ports[0].ContainerPort
-	}
-	instanceId := fmt.Sprintf("%s:%s:%d", pod.Status.PodIP, serviceName, port)
-	homePage := fmt.Sprintf("http://%s:%d/", pod.Status.PodIP, port)
-	statusPageUrl := fmt.Sprintf("http://%s:%s/actuator/info", pod.Status.PodIP, managementPort)
-	healthCheckUrl := fmt.Sprintf("http://%s:%s/actuator/health", pod.Status.PodIP, managementPort)
+	vipAddress := serviceName
+	if vip, ok := keys.LookupVipAddress(labels); ok && len(vip) > 0 {
+		vipAddress = vip
+	}
+	secureVipAddress := vipAddress
+	if vip, ok := keys.LookupSecureVipAddress(labels); ok && len(vip) > 0 {
+		secureVipAddress = vip
+	}
+	scheme, homePort := "http", port
+	secure := entity.Port{Port: 443, Enabled: false}
+	if securePort > 0 {
+		scheme, homePort = "https", securePort
+		secure = entity.Port{Port: securePort, Enabled: true}
+	}
+	homePage := BaseUrl(scheme, ip, homePort) + "/"
+	managementScheme := "http"
+	if managementSecure {
+		managementScheme = "https"
+	}
+	managementUrl := fmt.Sprintf("%s://%s", managementScheme, net.JoinHostPort(ip, managementPort))
+	statusPageUrl := managementUrl + "/actuator/info"
+	healthCheckUrl := managementUrl + "/actuator/health"
 	instance := &entity.Instance{
-		HostName:         pod.Status.PodIP,
+		HostName:         ip,
 		App:              serviceName,
-		IPAddr:           pod.Status.PodIP,
-		Status:           entity.UP,
+		IPAddr:           ip,
+		Status:           status,
 		InstanceId:       instanceId,
 		OverriddenStatus: entity.UNKNOWN,
 		Port: entity.Port{
 			Port:    port,
-			Enabled: true,
-		},
-		SecurePort: entity.Port{
-			Port:    443,
-			Enabled: false,
+			Enabled: port != securePort,
 		},
+		SecurePort:                    secure,
 		CountryId:                     8,
 		ActionType:                    entity.ADDED,
 		LastDirtyTimestamp:            now,
 		LastUpdatedTimestamp:          now,
 		IsCoordinatingDiscoveryServer: true,
-		SecureVipAddress:              serviceName,
-		VipAddress:                    serviceName,
+		SecureVipAddress:              secureVipAddress,
+		VipAddress:                    vipAddress,
 		DataCenterInfo: entity.DataCenterInfo{
 			Class: entity.DATA_CENTRE_CLASS,
 			Name:  entity.DATA_CENTRE_NAME,
@@ -106,10 +291,8 @@ func ConvertPod2Instance(pod *v1.Pod) *entity.Instance {
 		HealthCheckUrl: healthCheckUrl,
 	}
 	meteData := make(map[string]string)
-	meteData["provisioner"] = "pod"
-	meteData["pod-self-link"] = fmt.Sprintf("%s/%s", pod.GetNamespace(), pod.GetName())
-	meteData["version"] = pod.Labels[entity.ChoerodonVersion]
-	contextPath, ok := pod.Labels[entity.ChoerodonContextPathLabel]
+	meteData["version"], _ = keys.LookupVersion(labels)
+	contextPath, ok := keys.LookupContextPath(labels)
 	if ok {
 		meteData["context-path"] = contextPath
 	}
@@ -162,6 +345,267 @@ func recursive(singleMap map[string]interface{}, prefix string, recursiveMap map
 	}
 }
 
+// SelectServiceContainer 选择多容器 pod 中服务所在的容器，避免选中 istio 等先注入的 sidecar。
+// 依次按注解指定的容器名、注解指定的端口名、与服务名同名的容器、声明了 http 端口的容器、第一个声明了端口的容器选择
+func SelectServiceContainer(pod *v1.Pod, keys LabelKeys) *v1.Container {
+	containers := pod.Spec.Containers
+	if len(containers) == 0 {
+		return nil
+	}
+	if name, ok := pod.Annotations[entity.ChoerodonContainerAnnotation]; ok {
+		for i := range containers {
+			if containers[i].Name == name {
+				return &containers[i]
+			}
+		}
+	}
+	if portName, ok := pod.Annotations[entity.ChoerodonPortAnnotation]; ok {
+		if container := findContainerByPortName(containers, portName); container != nil {
+			return container
+		}
+	}
+	serviceName, _ := keys.LookupService(pod.Labels)
+	for i := range containers {
+		if containers[i].Name == serviceName {
+			return &containers[i]
+		}
+	}
+	if container := findContainerByPortName(containers, entity.DefaultPortName); container != nil {
+		return container
+	}
+	for i := range containers {
+		if len(containers[i].Ports) > 0 {
+			return &containers[i]
+		}
+	}
+	return &containers[0]
+}
+
+func findContainerByPortName(containers []v1.Container, portName string) *v1.Container {
+	for i := range containers {
+		for _, port := range containers[i].Ports {
+			if port.Name == portName {
+				return &containers[i]
+			}
+		}
+	}
+	return nil
+}
+
+// SelectServicePort 选择容器中的服务端口，依次按注解指定的端口号或端口名、名为 http 的端口、第一个端口选择
+func SelectServicePort(pod *v1.Pod, container *v1.Container) int32 {
+	if portValue, ok := pod.Annotations[entity.ChoerodonPortAnnotation]; ok {
+		if port, err := strconv.ParseInt(portValue, 10, 32); err == nil {
+			return int32(port)
+		}
+	}
+	if container == nil || len(container.Ports) == 0 {
+		return 0
+	}
+	portName, ok := pod.Annotations[entity.ChoerodonPortAnnotation]
+	if !ok {
+		portName = entity.DefaultPortName
+	}
+	for _, port := range container.Ports {
+		if port.Name == portName {
+			return port.ContainerPort
+		}
+	}
+	return container.Ports[0].ContainerPort
+}
+
+// PodIPs 返回 pod 的所有 ip，主 ip 在前，未启用双栈的集群中只有 status.podIP
+func PodIPs(pod *v1.Pod) []string {
+	ips := make([]string, 0, len(pod.Status.PodIPs)+1)
+	if len(pod.Status.PodIP) > 0 {
+		ips = append(ips, pod.Status.PodIP)
+	}
+	for _, podIP := range pod.Status.PodIPs {
+		if podIP.IP != pod.Status.PodIP {
+			ips = append(ips, podIP.IP)
+		}
+	}
+	return ips
+}
+
+// SelectPodIP 按地址族策略选择 pod 注册的 ip，pod 没有所选地址族的 ip 时使用主 ip
+func SelectPodIP(pod *v1.Pod, policy string) string {
+	wantIpv6 := strings.EqualFold(policy, IpFamilyPolicyIpv6)
+	if strings.EqualFold(policy, IpFamilyPolicyIpv4) || wantIpv6 {
+		for _, ip := range PodIPs(pod) {
+			if isIpv6(ip) == wantIpv6 {
+				return ip
+			}
+		}
+	}
+	return pod.Status.PodIP
+}
+
+// setAddressMetadata 将各地址族的第一个 ip 记录到实例的 ipv4、ipv6 元数据
+func setAddressMetadata(metadata entity.Metadata, ips []string) {
+	for _, ip := range ips {
+		key := Ipv4MetadataKey
+		if isIpv6(ip) {
+			key = Ipv6MetadataKey
+		}
+		if _, ok := metadata[key]; !ok {
+			metadata[key] = ip
+		}
+	}
+}
+
+func isIpv6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
+
+// IpInstanceId 返回 ip:服务名:端口 形式的实例 id，IPv6 地址加上方括号以免与分隔符混淆。
+// pod、Endpoints 与心跳注册的实例使用相同的格式
+func IpInstanceId(ip string, serviceName string, port int32) string {
+	if isIpv6(ip) {
+		ip = "[" + ip + "]"
+	}
+	return fmt.Sprintf("%s:%s:%d", ip, serviceName, port)
+}
+
+// IsValidIpFamilyPolicy 返回 ip 地址族配置是否为 primary、ipv4 或 ipv6 之一
+func IsValidIpFamilyPolicy(policy string) bool {
+	for _, valid := range []string{IpFamilyPolicyPrimary, IpFamilyPolicyIpv4, IpFamilyPolicyIpv6} {
+		if strings.EqualFold(policy, valid) {
+			return true
+		}
+	}
+	return false
+}
+
+// BaseUrl 返回 scheme://host:port 形式的地址，IPv6 地址加上方括号
+func BaseUrl(scheme string, host string, port int32) string {
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, strconv.Itoa(int(port))))
+}
+
+// SelectSecurePort 选择 choerodon.io/secure-port 注解或标签指定的 https 端口，可以是端口号或服务容器中的端口名，
+// 注解优先。未指定或端口名不存在时返回 0，即不启用 https 端口
+func SelectSecurePort(pod *v1.Pod, container *v1.Container) int32 {
+	value, ok := pod.Annotations[entity.ChoerodonSecurePortAnnotation]
+	if !ok {
+		value = pod.Labels[entity.ChoerodonSecurePortAnnotation]
+	}
+	if port, err := strconv.ParseInt(value, 10, 32); err == nil {
+		return int32(port)
+	}
+	if container == nil || len(value) == 0 {
+		return 0
+	}
+	for _, port := range container.Ports {
+		if port.Name == value {
+			return port.ContainerPort
+		}
+	}
+	return 0
+}
+
+// selectSecureEndpointPort 选择 Service 的 choerodon.io/secure-port 注解或标签指定的 https 端口，规则与 SelectSecurePort 相同
+func selectSecureEndpointPort(ports []v1.EndpointPort, service *v1.Service) int32 {
+	value, ok := service.Annotations[entity.ChoerodonSecurePortAnnotation]
+	if !ok {
+		value = service.Labels[entity.ChoerodonSecurePortAnnotation]
+	}
+	if port, err := strconv.ParseInt(value, 10, 32); err == nil {
+		return int32(port)
+	}
+	for _, port := range ports {
+		if len(value) > 0 && port.Name == value {
+			return port.Port
+		}
+	}
+	return 0
+}
+
+// isManagementSecure 返回 choerodon.io/management-secure 注解或标签是否为 true，注解优先
+func isManagementSecure(annotations map[string]string, labels map[string]string) bool {
+	value, ok := annotations[entity.ChoerodonManagementSecureAnnotation]
+	if !ok {
+		value = labels[entity.ChoerodonManagementSecureAnnotation]
+	}
+	return value == "true"
+}
+
+// IsPodReady 判断 pod 是否就绪。通过注解指定了服务容器时只判断该容器，否则使用 pod 的 Ready 状态
+func IsPodReady(pod *v1.Pod) bool {
+	if name, ok := pod.Annotations[entity.ChoerodonContainerAnnotation]; ok {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name == name {
+				return status.Ready && status.State.Running != nil
+			}
+		}
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// PodInstanceStatus 返回 pod 对应实例的状态，返回空字符串表示 pod 不应注册。
+// 正在删除的 pod 立即下线，使客户端在 preStop 期间摘除流量；运行中但未就绪的 pod 为 STARTING
+func PodInstanceStatus(pod *v1.Pod, options PodConvertOptions) string {
+	if len(pod.Status.PodIP) == 0 || pod.Status.Phase != v1.PodRunning {
+		return ""
+	}
+	if pod.DeletionTimestamp != nil {
+		if options.TerminatingStatus == entity.DOWN {
+			return entity.DOWN
+		}
+		return entity.OUTOFSERVICE
+	}
+	if IsPodReady(pod) {
+		return entity.UP
+	}
+	return entity.STARTING
+}
+
+// NodeTopology 返回节点所在的可用区与地域，优先使用 topology.kubernetes.io 标签
+func NodeTopology(node *v1.Node) (string, string) {
+	zone, region := node.Labels[entity.TopologyZoneLabel], node.Labels[entity.TopologyRegionLabel]
+	if len(zone) == 0 {
+		zone = node.Labels[entity.LegacyTopologyZoneLabel]
+	}
+	if len(region) == 0 {
+		region = node.Labels[entity.LegacyTopologyRegionLabel]
+	}
+	return zone, region
+}
+
+// NodeNotReadySince 返回节点未就绪的起始时间，节点失联时 Ready 状态为 Unknown，同样视为未就绪。
+// 没有 Ready 状态的节点视为就绪
+func NodeNotReadySince(node *v1.Node) (time.Time, bool) {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			if condition.Status == v1.ConditionTrue {
+				return time.Time{}, false
+			}
+			return condition.LastTransitionTime.Time, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// SetInstanceTopology 将可用区与地域写入实例的 zone、region 元数据与 dataCenterInfo，为空的值不写入
+func SetInstanceTopology(instance *entity.Instance, zone string, region string) {
+	if len(zone) == 0 && len(region) == 0 {
+		return
+	}
+	if len(zone) > 0 {
+		instance.Metadata[entity.ZoneMetadataKey] = zone
+	}
+	if len(region) > 0 {
+		instance.Metadata[entity.RegionMetadataKey] = region
+	}
+	instance.DataCenterInfo.Metadata = &entity.DataCenterMetadata{AvailabilityZone: zone, Region: region}
+}
+
 func Sha256(data string) string {
 	h := sha256.New()
 	h.Write([]byte(data))
@@ -187,3 +631,25 @@ func DeepCopyInstance(instance *entity.Instance) (*entity.Instance, error) {
 		return clone, nil
 	}
 }
+
+// ConvertActuatorHealth 将 spring actuator 健康检查的响应转换为实例状态。
+// actuator 在 DOWN 与 OUT_OF_SERVICE 时返回 503，响应体无法解析时按状态码判断
+func ConvertActuatorHealth(statusCode int, body []byte) string {
+	health := struct {
+		Status string `json:"status"`
+	}{}
+	if err := json.Unmarshal(body, &health); err == nil {
+		switch strings.ToUpper(health.Status) {
+		case entity.UP:
+			return entity.UP
+		case entity.DOWN:
+			return entity.DOWN
+		case entity.OUTOFSERVICE:
+			return entity.OUTOFSERVICE
+		}
+	}
+	if statusCode >= 200 && statusCode < 300 {
+		return entity.UP
+	}
+	return entity.DOWN
+}
@@ -3,6 +3,12 @@ package utils
 import (
 	"fmt"
 	"testing"
+	"time"
+
+	"github.com/choerodon/go-register-server/pkg/api/entity"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 func TestConvertRecursiveMapToSingleMap(t *testing.T) {
@@ -14,3 +20,304 @@ func TestConvertRecursiveMapToSingleMap(t *testing.T) {
 		t.Errorf("ConvertRecursiveMapToSingleMap error")
 	}
 }
+
+func TestConvertActuatorHealth(t *testing.T) {
+	cases := []struct {
+		statusCode int
+		body       string
+		expect     string
+	}{
+		{200, `{"status":"UP"}`, entity.UP},
+		{503, `{"status":"DOWN","components":{"db":{"status":"DOWN"}}}`, entity.DOWN},
+		{503, `{"status":"OUT_OF_SERVICE"}`, entity.OUTOFSERVICE},
+		{200, `{"status":"UNKNOWN"}`, entity.UP},
+		{200, `ok`, entity.UP},
+		{500, `Internal Server Error`, entity.DOWN},
+	}
+	for _, c := range cases {
+		if status := ConvertActuatorHealth(c.statusCode, []byte(c.body)); status != c.expect {
+			t.Errorf("ConvertActuatorHealth(%d, %s) expect %s but %s", c.statusCode, c.body, c.expect, status)
+		}
+	}
+}
+
+func TestSelectServiceContainer(t *testing.T) {
+	sidecar := v1.Container{Name: "istio-proxy", Ports: []v1.ContainerPort{{Name: "http-envoy-prom", ContainerPort: 15090}}}
+	app := v1.Container{Name: "app", Ports: []v1.ContainerPort{
+		{Name: "actuator", ContainerPort: 8081}, {Name: "http", ContainerPort: 8080}}}
+	cases := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		container   string
+		port        int32
+	}{
+		{"named port", nil, nil, "app", 8080},
+		{"service label", map[string]string{entity.ChoerodonService: "istio-proxy"}, nil, "istio-proxy", 15090},
+		{"container annotation", nil, map[string]string{entity.ChoerodonContainerAnnotation: "app"}, "app", 8080},
+		{"port name annotation", nil, map[string]string{entity.ChoerodonPortAnnotation: "actuator"}, "app", 8081},
+		{"port number annotation", nil, map[string]string{entity.ChoerodonPortAnnotation: "9000"}, "app", 9000},
+	}
+	for _, c := range cases {
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Labels: c.labels, Annotations: c.annotations},
+			Spec:       v1.PodSpec{Containers: []v1.Container{sidecar, app}},
+		}
+		container := SelectServiceContainer(pod, LabelKeys{})
+		if container.Name != c.container {
+			t.Errorf("%s: SelectServiceContainer expect %s but %s", c.name, c.container, container.Name)
+		}
+		if port := SelectServicePort(pod, container); port != c.port {
+			t.Errorf("%s: SelectServicePort expect %d but %d", c.name, c.port, port)
+		}
+	}
+}
+
+func TestIsPodReady(t *testing.T) {
+	pod := &v1.Pod{
+		Status: v1.PodStatus{
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionFalse}},
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "log-shipper", Ready: false},
+				{Name: "app", Ready: true, State: v1.ContainerState{Running: &v1.ContainerStateRunning{}}},
+			},
+		},
+	}
+	if IsPodReady(pod) {
+		t.Errorf("IsPodReady should use the pod Ready condition")
+	}
+	pod.Annotations = map[string]string{entity.ChoerodonContainerAnnotation: "app"}
+	if !IsPodReady(pod) {
+		t.Errorf("IsPodReady should only check the annotated container")
+	}
+}
+
+func TestConvertPod2InstanceId(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-0", Namespace: "test",
+			Labels: map[string]string{entity.ChoerodonService: "app"}},
+		Spec: v1.PodSpec{Containers: []v1.Container{{Name: "app",
+			Ports: []v1.ContainerPort{{Name: "http", ContainerPort: 8080}}}}},
+		Status: v1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	if id := ConvertPod2Instance(pod, PodConvertOptions{}).InstanceId; id != "10.0.0.1:app:8080" {
+		t.Errorf("ConvertPod2Instance expect ip instance id but %s", id)
+	}
+	options := PodConvertOptions{InstanceIdScheme: InstanceIdSchemePod}
+	if id := ConvertPod2Instance(pod, options).InstanceId; id != "app-0.test:app:8080" {
+		t.Errorf("ConvertPod2Instance expect pod instance id but %s", id)
+	}
+}
+
+func TestPodInstanceStatus(t *testing.T) {
+	deleting := metav1.Now()
+	ready := []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	cases := []struct {
+		name    string
+		pod     *v1.Pod
+		options PodConvertOptions
+		status  string
+	}{
+		{"pending", &v1.Pod{Status: v1.PodStatus{Phase: v1.PodPending}}, PodConvertOptions{}, ""},
+		{"starting", &v1.Pod{Status: v1.PodStatus{Phase: v1.PodRunning, PodIP: "10.0.0.1"}},
+			PodConvertOptions{}, entity.STARTING},
+		{"ready", &v1.Pod{Status: v1.PodStatus{Phase: v1.PodRunning, PodIP: "10.0.0.1", Conditions: ready}},
+			PodConvertOptions{}, entity.UP},
+		{"terminating", &v1.Pod{ObjectMeta: metav1.ObjectMeta{DeletionTimestamp: &deleting},
+			Status: v1.PodStatus{Phase: v1.PodRunning, PodIP: "10.0.0.1", Conditions: ready}},
+			PodConvertOptions{}, entity.OUTOFSERVICE},
+		{"terminating down", &v1.Pod{ObjectMeta: metav1.ObjectMeta{DeletionTimestamp: &deleting},
+			Status: v1.PodStatus{Phase: v1.PodRunning, PodIP: "10.0.0.1", Conditions: ready}},
+			PodConvertOptions{TerminatingStatus: entity.DOWN}, entity.DOWN},
+	}
+	for _, c := range cases {
+		if status := PodInstanceStatus(c.pod, c.options); status != c.status {
+			t.Errorf("%s: PodInstanceStatus expect %s but %s", c.name, c.status, status)
+		}
+	}
+}
+
+func TestConvertEndpoints2Instances(t *testing.T) {
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "redis-admin", Namespace: "test",
+		Annotations: map[string]string{entity.ChoerodonRegisterAnnotation: "true", entity.ChoerodonPort: "metrics"}}}
+	endpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "redis-admin", Namespace: "test"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses:         []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "10.0.0.2"}},
+			Ports:             []v1.EndpointPort{{Name: "metrics", Port: 9090}, {Name: "http", Port: 8080}},
+		}},
+	}
+	instances := ConvertEndpoints2Instances(service, endpoints, PodConvertOptions{})
+	if len(instances) != 2 {
+		t.Fatalf("ConvertEndpoints2Instances expect 2 instances but %d", len(instances))
+	}
+	if instances[0].InstanceId != "10.0.0.1:redis-admin:8080" || instances[0].Status != entity.UP {
+		t.Errorf("ConvertEndpoints2Instances ready address error: %s %s", instances[0].InstanceId, instances[0].Status)
+	}
+	if instances[1].Status != entity.STARTING {
+		t.Errorf("ConvertEndpoints2Instances expect not ready address STARTING but %s", instances[1].Status)
+	}
+	if instances[0].HealthCheckUrl != "http://10.0.0.1:9090/actuator/health" {
+		t.Errorf("ConvertEndpoints2Instances management port error: %s", instances[0].HealthCheckUrl)
+	}
+}
+
+func TestConvertPod2InstanceLabelKeys(t *testing.T) {
+	keys := LabelKeys{
+		Service:    []string{entity.ChoerodonService, "app.kubernetes.io/name"},
+		Version:    []string{entity.ChoerodonVersion, "app.kubernetes.io/version"},
+		VipAddress: []string{entity.ChoerodonVipAddress, "example.com/vip"},
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{
+			"app.kubernetes.io/name": "app", "app.kubernetes.io/version": "1.0.0", "example.com/vip": "app-vip"}},
+		Spec: v1.PodSpec{Containers: []v1.Container{{Name: "app",
+			Ports: []v1.ContainerPort{{Name: "http", ContainerPort: 8080}}}}},
+		Status: v1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	instance := ConvertPod2Instance(pod, PodConvertOptions{LabelKeys: keys})
+	if instance.App != "app" || instance.Metadata["version"] != "1.0.0" {
+		t.Errorf("ConvertPod2Instance should fall back to app.kubernetes.io labels: %s %s",
+			instance.App, instance.Metadata["version"])
+	}
+	if instance.VipAddress != "app-vip" || instance.SecureVipAddress != "app-vip" {
+		t.Errorf("ConvertPod2Instance should fall back to the configured vip label: %s %s",
+			instance.VipAddress, instance.SecureVipAddress)
+	}
+	pod.Labels[entity.ChoerodonService] = "choerodon-app"
+	if instance := ConvertPod2Instance(pod, PodConvertOptions{LabelKeys: keys}); instance.App != "choerodon-app" {
+		t.Errorf("ConvertPod2Instance should prefer the first label key but %s", instance.App)
+	}
+}
+
+func TestConvertPod2InstanceMetadata(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{entity.ChoerodonService: "app", entity.ChoerodonVersion: "1.0.0",
+				"eureka.metadata/group": "blue", "eureka.metadata/version": "2.0.0", "canary": "false"},
+			Annotations: map[string]string{"eureka.metadata/weight": "10", "example.com/canary": "true"},
+		},
+		Spec: v1.PodSpec{Containers: []v1.Container{{Name: "app"}}},
+	}
+	options := PodConvertOptions{MetadataPrefixes: []string{"eureka.metadata/"}, MetadataKeys: []string{"example.com/canary"}}
+	metadata := ConvertPod2Instance(pod, options).Metadata
+	if metadata["group"] != "blue" || metadata["weight"] != "10" || metadata["canary"] != "true" {
+		t.Errorf("ConvertPod2Instance should copy selected labels and annotations: %v", metadata)
+	}
+	if metadata["version"] != "1.0.0" {
+		t.Errorf("ConvertPod2Instance should not override reserved metadata but version is %s", metadata["version"])
+	}
+}
+
+func TestSetInstanceTopology(t *testing.T) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{
+		entity.TopologyZoneLabel: "zone-a", entity.LegacyTopologyRegionLabel: "region-1"}}}
+	instance := &entity.Instance{Metadata: entity.Metadata{}}
+	zone, region := NodeTopology(node)
+	SetInstanceTopology(instance, zone, region)
+	if instance.Metadata["zone"] != "zone-a" || instance.Metadata["region"] != "region-1" {
+		t.Errorf("SetInstanceTopology metadata error: %v", instance.Metadata)
+	}
+	if instance.DataCenterInfo.Metadata == nil || instance.DataCenterInfo.Metadata.AvailabilityZone != "zone-a" {
+		t.Errorf("SetInstanceTopology dataCenterInfo error: %+v", instance.DataCenterInfo)
+	}
+}
+
+func TestNodeNotReadySince(t *testing.T) {
+	transition := metav1.NewTime(time.Now().Add(-time.Minute))
+	node := &v1.Node{Status: v1.NodeStatus{Conditions: []v1.NodeCondition{
+		{Type: v1.NodeReady, Status: v1.ConditionUnknown, LastTransitionTime: transition}}}}
+	if since, notReady := NodeNotReadySince(node); !notReady || !since.Equal(transition.Time) {
+		t.Errorf("NodeNotReadySince of unreachable node error: %v %v", since, notReady)
+	}
+	node.Status.Conditions[0].Status = v1.ConditionTrue
+	if _, notReady := NodeNotReadySince(node); notReady {
+		t.Errorf("NodeNotReadySince of ready node should be false")
+	}
+}
+
+func TestConvertPod2InstanceSecurePort(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      map[string]string{entity.ChoerodonService: "app", entity.ChoerodonPort: "8081"},
+			Annotations: map[string]string{entity.ChoerodonSecurePortAnnotation: "https"}},
+		Spec: v1.PodSpec{Containers: []v1.Container{{Name: "app",
+			Ports: []v1.ContainerPort{{Name: "http", ContainerPort: 8080}, {Name: "https", ContainerPort: 8443}}}}},
+		Status: v1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	instance := ConvertPod2Instance(pod, PodConvertOptions{})
+	if !instance.SecurePort.Enabled || instance.SecurePort.Port != 8443 || !instance.Port.Enabled {
+		t.Errorf("ConvertPod2Instance secure port error: %+v %+v", instance.Port, instance.SecurePort)
+	}
+	if instance.HomePageUrl != "https://10.0.0.1:8443/" || instance.HealthCheckUrl != "http://10.0.0.1:8081/actuator/health" {
+		t.Errorf("ConvertPod2Instance expect https home page and http management urls but %s %s",
+			instance.HomePageUrl, instance.HealthCheckUrl)
+	}
+	pod.Annotations[entity.ChoerodonManagementSecureAnnotation] = "true"
+	if instance := ConvertPod2Instance(pod, PodConvertOptions{}); instance.StatusPageUrl != "https://10.0.0.1:8081/actuator/info" {
+		t.Errorf("ConvertPod2Instance expect https management urls but %s", instance.StatusPageUrl)
+	}
+
+	pod.Annotations[entity.ChoerodonSecurePortAnnotation] = "missing"
+	if instance := ConvertPod2Instance(pod, PodConvertOptions{}); instance.SecurePort.Enabled ||
+		instance.HomePageUrl != "http://10.0.0.1:8080/" {
+		t.Errorf("ConvertPod2Instance should not enable a missing secure port: %+v", instance.SecurePort)
+	}
+}
+
+func TestConvertDualStackPod2Instance(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{entity.ChoerodonService: "app", entity.ChoerodonPort: "8081"}},
+		Spec: v1.PodSpec{Containers: []v1.Container{{Name: "app",
+			Ports: []v1.ContainerPort{{Name: "http", ContainerPort: 8080}}}}},
+		Status: v1.PodStatus{PodIP: "10.0.0.1", PodIPs: []v1.PodIP{{IP: "10.0.0.1"}, {IP: "fd00::1"}}},
+	}
+	instance := ConvertPod2Instance(pod, PodConvertOptions{})
+	if instance.IPAddr != "10.0.0.1" || instance.HomePageUrl != "http://10.0.0.1:8080/" {
+		t.Errorf("ConvertPod2Instance expect the primary ip but %s", instance.IPAddr)
+	}
+	if instance.Metadata["ipv4"] != "10.0.0.1" || instance.Metadata["ipv6"] != "fd00::1" {
+		t.Errorf("ConvertPod2Instance should keep both addresses in metadata: %v", instance.Metadata)
+	}
+
+	instance = ConvertPod2Instance(pod, PodConvertOptions{IpFamilyPolicy: IpFamilyPolicyIpv6})
+	if instance.IPAddr != "fd00::1" || instance.HomePageUrl != "http://[fd00::1]:8080/" ||
+		instance.HealthCheckUrl != "http://[fd00::1]:8081/actuator/health" {
+		t.Errorf("ConvertPod2Instance expect bracketed ipv6 urls but %s %s", instance.HomePageUrl, instance.HealthCheckUrl)
+	}
+	if instance.InstanceId != "[fd00::1]:app:8080" {
+		t.Errorf("ConvertPod2Instance expect bracketed ipv6 instance id but %s", instance.InstanceId)
+	}
+	if IsValidIpFamilyPolicy("ipv5") || !IsValidIpFamilyPolicy("IPv6") {
+		t.Errorf("IsValidIpFamilyPolicy error")
+	}
+
+	pod.Status.PodIPs = nil
+	if ip := SelectPodIP(pod, IpFamilyPolicyIpv6); ip != "10.0.0.1" {
+		t.Errorf("SelectPodIP should fall back to the primary ip but %s", ip)
+	}
+}
+
+func TestIpInstanceId(t *testing.T) {
+	if id := IpInstanceId("10.0.0.1", "app", 8080); id != "10.0.0.1:app:8080" {
+		t.Errorf("IpInstanceId error: %s", id)
+	}
+	// 心跳注册的 IPv6 实例与 pod 生成的实例 id 格式一致
+	if id := IpInstanceId("fd00::1", "app", 8080); id != "[fd00::1]:app:8080" {
+		t.Errorf("IpInstanceId expect bracketed ipv6 but %s", id)
+	}
+}
+
+func TestConfigMapInstanceKey(t *testing.T) {
+	for _, instanceId := range []string{"10.0.0.1:app:8080", "[fd00::1]:app:8080", "app-0.test:app:8080"} {
+		key := ConfigMapInstanceKey(instanceId)
+		if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+			t.Errorf("ConfigMapInstanceKey of %s is not a valid config map key %s: %v", instanceId, key, errs)
+		}
+	}
+	if key := ConfigMapInstanceKey("10.0.0.1:app:8080"); key != "10.0.0.1-app-8080" {
+		t.Errorf("ConfigMapInstanceKey should keep the ipv4 key unchanged but %s", key)
+	}
+}
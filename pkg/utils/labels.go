@@ -0,0 +1,74 @@
+package utils
+
+import "github.com/choerodon/go-register-server/pkg/api/entity"
+
+// LabelKeys 是从 pod 标签、Service 与 ConfigMap 注解中读取服务信息时使用的键。
+// 每项按顺序取第一个存在的键，为空时使用 choerodon.io 的默认键，写入时使用每项的第一个键
+type LabelKeys struct {
+	Service          []string
+	Version          []string
+	ManagementPort   []string
+	ContextPath      []string
+	Feature          []string
+	VipAddress       []string
+	SecureVipAddress []string
+}
+
+func (keys LabelKeys) LookupService(labels map[string]string) (string, bool) {
+	return lookupLabel(labels, keys.Service, entity.ChoerodonService)
+}
+
+func (keys LabelKeys) LookupVersion(labels map[string]string) (string, bool) {
+	return lookupLabel(labels, keys.Version, entity.ChoerodonVersion)
+}
+
+func (keys LabelKeys) LookupManagementPort(labels map[string]string) (string, bool) {
+	return lookupLabel(labels, keys.ManagementPort, entity.ChoerodonPort)
+}
+
+func (keys LabelKeys) LookupContextPath(labels map[string]string) (string, bool) {
+	return lookupLabel(labels, keys.ContextPath, entity.ChoerodonContextPathLabel)
+}
+
+func (keys LabelKeys) LookupFeature(labels map[string]string) (string, bool) {
+	return lookupLabel(labels, keys.Feature, entity.ChoerodonFeature)
+}
+
+func (keys LabelKeys) LookupVipAddress(labels map[string]string) (string, bool) {
+	return lookupLabel(labels, keys.VipAddress, entity.ChoerodonVipAddress)
+}
+
+func (keys LabelKeys) LookupSecureVipAddress(labels map[string]string) (string, bool) {
+	return lookupLabel(labels, keys.SecureVipAddress, entity.ChoerodonSecureVipAddress)
+}
+
+func (keys LabelKeys) ServiceKey() string {
+	return firstKey(keys.Service, entity.ChoerodonService)
+}
+
+func (keys LabelKeys) VersionKey() string {
+	return firstKey(keys.Version, entity.ChoerodonVersion)
+}
+
+func (keys LabelKeys) FeatureKey() string {
+	return firstKey(keys.Feature, entity.ChoerodonFeature)
+}
+
+func lookupLabel(labels map[string]string, keys []string, defaultKey string) (string, bool) {
+	if len(keys) == 0 {
+		keys = []string{defaultKey}
+	}
+	for _, key := range keys {
+		if value, ok := labels[key]; ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func firstKey(keys []string, defaultKey string) string {
+	if len(keys) == 0 {
+		return defaultKey
+	}
+	return keys[0]
+}
@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// NewInstanceClient 返回请求实例的 http 客户端。caFile 不为空时，除系统 CA 外还信任其中的 PEM 格式 CA 证书，
+// 用于校验只提供 https 的实例的证书。请求发往 pod ip，serverName 不为空时以该名称而不是 ip 校验实例的证书
+func NewInstanceClient(timeout time.Duration, caFile string, serverName string) (*http.Client, error) {
+	client := &http.Client{Timeout: timeout}
+	if len(caFile) == 0 && len(serverName) == 0 {
+		return client, nil
+	}
+	tlsConfig := &tls.Config{ServerName: serverName}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client.Transport = transport
+	if len(caFile) == 0 {
+		return client, nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return client, fmt.Errorf("read CA bundle %s: %v", caFile, err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return client, fmt.Errorf("no certificate found in CA bundle %s", caFile)
+	}
+	tlsConfig.RootCAs = pool
+	return client, nil
+}
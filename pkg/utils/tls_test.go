@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewInstanceClientServerName(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	caFile, err := ioutil.TempFile("", "ca-*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	_ = pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	_ = caFile.Close()
+
+	// httptest 的证书包含 example.com，不包含 localhost
+	url := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	client, err := NewInstanceClient(time.Second, caFile.Name(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(url); err == nil {
+		t.Errorf("NewInstanceClient should verify the certificate against the request host")
+	}
+	client, err = NewInstanceClient(time.Second, caFile.Name(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(url); err != nil {
+		t.Errorf("NewInstanceClient should verify the certificate against the server name: %v", err)
+	}
+}